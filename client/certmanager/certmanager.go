@@ -0,0 +1,223 @@
+package certmanager
+
+/*
+Holds the device's certificate for a TLS server and swaps in a new one
+when it is renewed, so the server never needs restarting. It works with
+anything that takes a tls.Config:
+
+	manager, err := certmanager.New("cert.pem", "private.key", certmanager.Options{})
+	go manager.Watch(ctx)
+	server := &http.Server{Addr: ":8443", TLSConfig: manager.TLSConfig()}
+	server.ListenAndServeTLS("", "")
+
+The files are checked every Options.Interval rather than with inotify
+and friends, which not every device has. If only one of the pair has
+been replaced when it looks, the old certificate is kept and it tries
+again next time. A manager made with NewFromPEM has no files, it is
+updated with SetKeyPair.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const DefaultInterval = time.Minute
+
+var ErrNoCertificate = errors.New("No certificate has been loaded")
+
+type Options struct {
+	// How often to look at the files, DefaultInterval if zero
+	Interval time.Duration
+	// Called after a new certificate is loaded
+	OnReload func(certificate *x509.Certificate)
+	// Called when the files have changed but can't be loaded
+	OnError func(err error)
+}
+
+type Manager struct {
+	certFile string
+	keyFile  string
+	options  Options
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	// What the files looked like when they were last loaded
+	certState fileState
+	keyState  fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Loads the pair from the files, which must already exist
+func New(certFile string, keyFile string, options Options) (*Manager, error) {
+	m := newManager(options)
+	m.certFile = certFile
+	m.keyFile = keyFile
+	if _, err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// For a key pair held in memory. Both can be nil if there isn't one yet,
+// GetCertificate fails until SetKeyPair is called.
+func NewFromPEM(certPEM []byte, keyPEM []byte, options Options) (*Manager, error) {
+	m := newManager(options)
+	if certPEM != nil || keyPEM != nil {
+		if err := m.SetKeyPair(certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func newManager(options Options) *Manager {
+	if options.Interval == 0 {
+		options.Interval = DefaultInterval
+	}
+	return &Manager{options: options}
+}
+
+// Replaces the certificate, the old one is kept if the new pair can't be
+// used
+func (m *Manager) SetKeyPair(certPEM []byte, keyPEM []byte) error {
+	certificate, err := KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.certificate = certificate
+	m.mutex.Unlock()
+	if m.options.OnReload != nil {
+		m.options.OnReload(certificate.Leaf)
+	}
+	return nil
+}
+
+// Loads the files if they have changed since they were last loaded,
+// returns whether they were
+func (m *Manager) Reload() (bool, error) {
+	if m.certFile == "" {
+		return false, nil
+	}
+	certState, err := stat(m.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyState, err := stat(m.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	m.mutex.RLock()
+	unchanged := m.certificate != nil && certState == m.certState && keyState == m.keyState
+	m.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certPEM, err := ioutil.ReadFile(m.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(m.keyFile)
+	if err != nil {
+		return false, err
+	}
+	certificate, err := KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	m.mutex.Lock()
+	m.certificate = certificate
+	m.certState = certState
+	m.keyState = keyState
+	m.mutex.Unlock()
+
+	log.Debugf("Loaded the certificate from %s, it expires at %s", m.certFile, certificate.Leaf.NotAfter)
+	if m.options.OnReload != nil {
+		m.options.OnReload(certificate.Leaf)
+	}
+	return true, nil
+}
+
+// Checks the files for changes until the context is done
+func (m *Manager) Watch(ctx context.Context) {
+	if m.certFile == "" {
+		return
+	}
+	ticker := time.NewTicker(m.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Reload(); err != nil {
+				log.Debugf("Could not reload the certificate, keeping the old one: %s", err)
+				if m.options.OnError != nil {
+					m.options.OnError(err)
+				}
+			}
+		}
+	}
+}
+
+// For tls.Config.GetCertificate
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.certificate == nil {
+		return nil, ErrNoCertificate
+	}
+	return m.certificate, nil
+}
+
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.GetCertificate}
+}
+
+// The current certificate's leaf, nil if there isn't one
+func (m *Manager) Certificate() *x509.Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.certificate == nil {
+		return nil
+	}
+	return m.certificate.Leaf
+}
+
+// tls.X509KeyPair with the leaf parsed, the certificate PEM has the leaf
+// first
+func KeyPair(certPEM []byte, keyPEM []byte) (*tls.Certificate, error) {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+func stat(filename string) (fileState, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{modTime: info.ModTime(), size: info.Size()}, nil
+}
@@ -0,0 +1,144 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A self signed certificate for the name and its key, as PEM
+func testKeyPair(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "private.key")
+
+	// Each write moves the modification time on so the change is seen
+	// however coarse the filesystem's timestamps are
+	modTime := time.Now().Add(-time.Hour)
+	write := func(filename string, data []byte) {
+		if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certPEM, keyPEM := testKeyPair(t, "first.example.com")
+	write(certFile, certPEM)
+	write(keyFile, keyPEM)
+
+	reloads := 0
+	m, err := New(certFile, keyFile, Options{OnReload: func(*x509.Certificate) { reloads++ }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherCert, otherKey := testKeyPair(t, "other.example.com")
+	secondCert, secondKey := testKeyPair(t, "second.example.com")
+	steps := []struct {
+		name     string
+		change   func()
+		reloaded bool
+		wantErr  bool
+		want     string
+	}{
+		{"unchanged", func() {}, false, false, "first.example.com"},
+		{"only the certificate replaced", func() { write(certFile, otherCert) }, false, true, "first.example.com"},
+		{"still mismatched", func() {}, false, true, "first.example.com"},
+		{"key replaced to match", func() { write(keyFile, otherKey) }, true, false, "other.example.com"},
+		{"both replaced", func() { write(keyFile, secondKey); write(certFile, secondCert) }, true, false, "second.example.com"},
+		{"unchanged again", func() {}, false, false, "second.example.com"},
+		{"garbage", func() { write(certFile, []byte("not PEM")) }, false, true, "second.example.com"},
+	}
+	for _, step := range steps {
+		step.change()
+		reloaded, err := m.Reload()
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: error = %v, want error %t", step.name, err, step.wantErr)
+		}
+		if reloaded != step.reloaded {
+			t.Errorf("%s: reloaded = %t, want %t", step.name, reloaded, step.reloaded)
+		}
+		if got := m.Certificate().Subject.CommonName; got != step.want {
+			t.Errorf("%s: certificate for %s, want %s", step.name, got, step.want)
+		}
+	}
+	// The first load and the two changes
+	if reloads != 3 {
+		t.Errorf("OnReload called %d times, want 3", reloads)
+	}
+}
+
+func TestNewMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "private.key"), Options{}); err == nil {
+		t.Error("New loaded files which don't exist")
+	}
+}
+
+func TestNewFromPEM(t *testing.T) {
+	m, err := NewFromPEM(nil, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate(nil); err != ErrNoCertificate {
+		t.Errorf("GetCertificate error = %v, want %v", err, ErrNoCertificate)
+	}
+	if m.Certificate() != nil {
+		t.Error("Certificate is not nil before one is set")
+	}
+	if reloaded, err := m.Reload(); reloaded || err != nil {
+		t.Errorf("Reload without files = %t, %v", reloaded, err)
+	}
+
+	certPEM, keyPEM := testKeyPair(t, "device.example.com")
+	_, otherKey := testKeyPair(t, "other.example.com")
+	if err := m.SetKeyPair(certPEM, otherKey); err == nil {
+		t.Error("SetKeyPair took a mismatched pair")
+	}
+	if err := m.SetKeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Leaf.Subject.CommonName != "device.example.com" {
+		t.Errorf("certificate for %s", certificate.Leaf.Subject.CommonName)
+	}
+}
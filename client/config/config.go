@@ -1,23 +1,60 @@
 package config
 
+import "strings"
+import "github.com/digininja/ots-cert-demo/interop"
 import log "github.com/sirupsen/logrus"
 import "github.com/BurntSushi/toml"
 
 type webServer struct {
 	Port int
+	// Seconds between checks for a new certificate in CertFilename
+	ReloadInterval int
+}
+
+// Used to pick the IP addresses to register when the device has more
+// than one, see interop.IPPolicy
+type ipSelection struct {
+	Allow          []string
+	Deny           []string
+	SkipInterfaces []string
 }
 
 type Config struct {
 	ClientRegistrationURL string
 	CertificateRequestURL string
-	Interface             string
-	CertFilename          string
-	KeyFilename           string
-	CSRFilename           string
-	WebServer             webServer
+	// Asked for the renewal time, if empty it is renewal_info next to
+	// CertificateRequestURL
+	RenewalInfoURL string
+	Interface      string
+	IPSelection    ipSelection
+	CertFilename   string
+	KeyFilename    string
+	CSRFilename    string
+	// Where the client ID and names are kept so the client doesn't
+	// register again each time it starts, if empty it always registers
+	RegistrationFilename string
+	// Decides which of the server's tenants the client belongs to
+	EnrollmentToken string
+	// Optional details passed to the server to help it pick a hostname
+	Serial   string
+	Model    string
+	Hostname string
+	// A short extra name to ask for, the server may not allow it
+	Alias string
+	// How many times to retry when the server says it is rate limiting
+	// and the longest, in seconds, it will wait before a retry
+	MaxRetries   int
+	MaxRetryWait int
+	// PEM file of extra roots to trust when talking to the server, for
+	// when it has a certificate from a staging CA
+	StagingRoots string
+	// Subject fields for the CSR
+	CSRSubject interop.CSRSubject
+	WebServer  webServer
 }
 
 func NewConfig(configFile string) (cfg Config, err error) {
+	cfg.setDefaults()
 	err = cfg.parseFile(configFile)
 	if err != nil {
 		return cfg, err
@@ -25,6 +62,13 @@ func NewConfig(configFile string) (cfg Config, err error) {
 	return cfg, nil
 }
 
+// Anything not in the config file keeps these values
+func (cfg *Config) setDefaults() {
+	cfg.MaxRetries = 5
+	cfg.MaxRetryWait = 3600
+	cfg.WebServer.ReloadInterval = 60
+}
+
 func (cfg *Config) parseFile(configFile string) error {
 	if _, err := toml.DecodeFile(configFile, &cfg); err != nil {
 		return err
@@ -36,11 +80,26 @@ func (cfg Config) Dump() {
 	log.Print("Dumping configuration information")
 	log.Printf("Client Registration URL: %s", cfg.ClientRegistrationURL)
 	log.Printf("Certificate Request URL: %s", cfg.CertificateRequestURL)
+	log.Printf("Renewal Info URL: %s", cfg.RenewalInfoURL)
 	log.Printf("Interface: %s", cfg.Interface)
+	log.Printf("IP allow list: %s", strings.Join(cfg.IPSelection.Allow, ", "))
+	log.Printf("IP deny list: %s", strings.Join(cfg.IPSelection.Deny, ", "))
+	log.Printf("Skipped interfaces: %s", strings.Join(cfg.IPSelection.SkipInterfaces, ", "))
+	log.Printf("Enrollment token: %s", cfg.EnrollmentToken)
+	log.Printf("Serial: %s", cfg.Serial)
+	log.Printf("Model: %s", cfg.Model)
+	log.Printf("Requested hostname: %s", cfg.Hostname)
+	log.Printf("Requested alias: %s", cfg.Alias)
+	log.Printf("Max retries: %d", cfg.MaxRetries)
+	log.Printf("Max retry wait (s): %d", cfg.MaxRetryWait)
+	log.Printf("Staging roots: %s", cfg.StagingRoots)
 
 	log.Printf("Web server running on port: %d", cfg.WebServer.Port)
+	log.Printf("Certificate reload interval (s): %d", cfg.WebServer.ReloadInterval)
 
 	log.Printf("Certificate filename: %d", cfg.CertFilename)
 	log.Printf("Private key filename: %d", cfg.KeyFilename)
 	log.Printf("CSR filename: %d", cfg.CSRFilename)
+	log.Printf("Registration filename: %s", cfg.RegistrationFilename)
+	cfg.CSRSubject.Dump()
 }
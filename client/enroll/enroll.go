@@ -0,0 +1,341 @@
+package enroll
+
+/*
+Device side enrollment as a package, for firmware written in Go which
+wants to do what the client binary does itself.
+
+	enroller, err := enroll.New(enroll.Config{ServerURL: "https://otsserver.example.com:9443"},
+		enroll.NewFileStore("cert.pem", "private.key", "registration.json"))
+	if err := enroller.Enroll(ctx); err != nil {
+		...
+	}
+	server := &http.Server{Addr: ":8443", TLSConfig: enroller.TLSConfig()}
+	server.ListenAndServeTLS("", "")
+
+Enroll registers the device unless the store already has a registration
+and gets a certificate unless the stored one is still good. Renew gets
+a new certificate with a new key for the same names. Run calls it at the
+time the server gives for renewal, so to keep the certificate renewed:
+
+	go enroller.Run(ctx)
+
+The TLS config always serves the latest certificate so the server
+doesn't need restarting.
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/client/certmanager"
+	"github.com/digininja/ots-cert-demo/interop"
+	"github.com/digininja/ots-cert-demo/interop/apiclient"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+var ErrNotEnrolled = errors.New("The device has not been enrolled")
+
+type Config struct {
+	// The server's address, e.g. https://otsserver.example.com:9443
+	ServerURL string
+	// Retries, TLS settings and the endpoint paths, see apiclient.Options
+	API apiclient.Options
+
+	// Decides which of the server's tenants the device belongs to
+	EnrollmentToken string
+	// Optional details to help the server pick a hostname
+	Serial   string
+	Model    string
+	Hostname string
+	// A short extra name to ask for, the server may not allow it
+	Alias string
+
+	// The addresses to register, if empty they are picked with IPPolicy
+	IPs      []string
+	IPPolicy interop.IPPolicy
+
+	CSRSubject interop.CSRSubject
+	Events     Events
+}
+
+// Callbacks for things the device may want to show or act on. Any of
+// them can be nil. They are called from inside Enroll and Renew so
+// shouldn't block.
+type Events struct {
+	// For each address the server would not publish, whether or not the
+	// registration worked
+	IPRejected func(rejection interop.IPRejection)
+	Registered func(registration Registration, response *interop.RegClientResponse)
+	// The DER CSR, the client binary writes it out for debugging
+	CSRCreated        func(csr []byte)
+	CertificateIssued func(certificate *x509.Certificate, response *interop.CertificateResponse)
+	// A certificate from the store is being used rather than asking for
+	// a new one
+	CertificateLoaded func(certificate *x509.Certificate)
+	// A renewal started by Run failed, it is tried again later
+	RenewalFailed func(err error)
+}
+
+type Enroller struct {
+	config Config
+	store  KeyStore
+	api    *apiclient.Client
+
+	// Only one enrollment or renewal at a time
+	running sync.Mutex
+
+	mutex        sync.RWMutex
+	registration *Registration
+	certificates *certmanager.Manager
+}
+
+func New(config Config, store KeyStore) (*Enroller, error) {
+	if store == nil {
+		return nil, errors.New("A key store is needed")
+	}
+	api, err := apiclient.New(config.ServerURL, config.API)
+	if err != nil {
+		return nil, err
+	}
+	certificates, err := certmanager.NewFromPEM(nil, nil, certmanager.Options{})
+	if err != nil {
+		return nil, err
+	}
+	e := &Enroller{config: config, store: store, api: api, certificates: certificates}
+
+	registration, err := store.LoadRegistration()
+	if err == nil {
+		e.registration = &registration
+	} else if err != ErrNotStored {
+		return nil, errors.New(fmt.Sprintf("Could not load the registration: %s", err))
+	}
+	// A stored certificate can be served straight away, even if it is
+	// about to be replaced
+	certPEM, keyPEM, err := store.LoadKeyPair()
+	if err == nil {
+		err = certificates.SetKeyPair(certPEM, keyPEM)
+	}
+	if err != nil && err != ErrNotStored {
+		log.Debugf("Not using the stored certificate: %s", err)
+	}
+	return e, nil
+}
+
+// Registers the device if it isn't already and gets it a certificate if
+// it doesn't have a good one
+func (e *Enroller) Enroll(ctx context.Context) error {
+	e.running.Lock()
+	defer e.running.Unlock()
+
+	registration, ok := e.Registration()
+	if !ok {
+		var err error
+		registration, err = e.register(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if certificate := e.certificates.Certificate(); stillGood(certificate, registration) {
+		if e.config.Events.CertificateLoaded != nil {
+			e.config.Events.CertificateLoaded(certificate)
+		}
+		return nil
+	}
+	return e.issue(ctx, registration)
+}
+
+// Gets a new certificate with a new key, the device must have enrolled
+func (e *Enroller) Renew(ctx context.Context) error {
+	e.running.Lock()
+	defer e.running.Unlock()
+
+	registration, ok := e.Registration()
+	if !ok {
+		return ErrNotEnrolled
+	}
+	return e.issue(ctx, registration)
+}
+
+// Serves whatever the latest certificate is, so renewals are picked up
+// without restarting anything
+func (e *Enroller) TLSConfig() *tls.Config {
+	return e.certificates.TLSConfig()
+}
+
+func (e *Enroller) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return e.certificates.GetCertificate(hello)
+}
+
+func (e *Enroller) Registration() (Registration, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.registration == nil {
+		return Registration{}, false
+	}
+	return *e.registration, true
+}
+
+// The current certificate's leaf, nil if there isn't one
+func (e *Enroller) Certificate() *x509.Certificate {
+	return e.certificates.Certificate()
+}
+
+func (e *Enroller) register(ctx context.Context) (Registration, error) {
+	ips := e.config.IPs
+	if len(ips) == 0 {
+		var err error
+		ips, err = interop.SelectIPs(e.config.IPPolicy)
+		if err != nil {
+			return Registration{}, errors.New(fmt.Sprintf("Could not pick an IP address: %s", err))
+		}
+	}
+
+	clientID := uuid.New().String()
+	log.Debugf("UUID: %s", clientID)
+	request := interop.RegClientRequest{
+		ClientID:        clientID,
+		IPs:             ips,
+		EnrollmentToken: e.config.EnrollmentToken,
+		Serial:          e.config.Serial,
+		Model:           e.config.Model,
+		Hostname:        e.config.Hostname,
+		Alias:           e.config.Alias,
+	}
+	response, err := e.api.Register(ctx, request)
+	if e.config.Events.IPRejected != nil {
+		for _, rejection := range response.RejectedIPs {
+			e.config.Events.IPRejected(rejection)
+		}
+	}
+	if err != nil {
+		return Registration{}, err
+	}
+
+	// Older servers only send the hostname
+	names := response.Names
+	if len(names) == 0 {
+		names = []string{response.Hostname}
+	}
+	registration := Registration{ClientID: clientID, Hostname: response.Hostname, Names: names}
+	if err := e.setRegistration(registration); err != nil {
+		return Registration{}, err
+	}
+
+	if e.config.Events.Registered != nil {
+		e.config.Events.Registered(registration, response)
+	}
+	return registration, nil
+}
+
+func (e *Enroller) issue(ctx context.Context, registration Registration) error {
+	log.Debug("Generating the private key")
+	key, err := rsa.GenerateKey(rand.Reader, interop.BIT_SIZE)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not generate the private key: %s", err))
+	}
+	csr, err := interop.CreateCSR(registration.Names, e.config.CSRSubject, key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not generate the CSR: %s", err))
+	}
+	if e.config.Events.CSRCreated != nil {
+		e.config.Events.CSRCreated(csr)
+	}
+
+	response, err := e.api.RequestCertificate(ctx, registration.ClientID, csr)
+	if err != nil {
+		return err
+	}
+	if len(response.Certificates) == 0 {
+		return errors.New("The server did not send a certificate")
+	}
+
+	var certPEM []byte
+	for _, certificate := range response.Certificates {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})...)
+	}
+	keyPEM := interop.EncodePrivateKey(key)
+
+	// Checked before it is saved so a bad certificate doesn't replace a
+	// good one
+	certificate, err := certmanager.KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.New(fmt.Sprintf("The server sent a certificate which can't be used: %s", err))
+	}
+	if err := e.store.SaveKeyPair(certPEM, keyPEM); err != nil {
+		return errors.New(fmt.Sprintf("Could not save the certificate: %s", err))
+	}
+	if err := e.certificates.SetKeyPair(certPEM, keyPEM); err != nil {
+		return err
+	}
+
+	// The renewal time goes with the certificate, a server which doesn't
+	// send one leaves it to the default
+	registration.RenewAt = time.Time{}
+	if response.Renewal != nil {
+		registration.RenewAt = response.Renewal.RenewAt
+	}
+	if err := e.setRegistration(registration); err != nil {
+		return err
+	}
+
+	if e.config.Events.CertificateIssued != nil {
+		e.config.Events.CertificateIssued(certificate.Leaf, response)
+	}
+	return nil
+}
+
+// Saves the registration and makes it the current one
+func (e *Enroller) setRegistration(registration Registration) error {
+	if err := e.store.SaveRegistration(registration); err != nil {
+		return errors.New(fmt.Sprintf("Could not save the registration: %s", err))
+	}
+	e.mutex.Lock()
+	e.registration = &registration
+	e.mutex.Unlock()
+	return nil
+}
+
+// Good enough to keep using rather than asking for a new one straight
+// away. It has to cover the registered names exactly and not have
+// reached its renewal time.
+func stillGood(certificate *x509.Certificate, registration Registration) bool {
+	if certificate == nil {
+		return false
+	}
+	if !sameNames(certificate.DNSNames, registration.Names) {
+		log.Debug("The stored certificate is not for the registered names")
+		return false
+	}
+	if time.Now().After(renewalTime(certificate, registration.RenewAt)) {
+		log.Debug("The stored certificate is due to be renewed")
+		return false
+	}
+	return true
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
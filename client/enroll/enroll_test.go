@@ -0,0 +1,256 @@
+package enroll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/digininja/ots-cert-demo/interop"
+	"github.com/digininja/ots-cert-demo/interop/apiclient"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stands in for the registration server, issuing from its own CA key
+type fakeServer struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mutex    sync.Mutex
+	requests map[string]int
+	names    []string
+	rejected []interop.IPRejection
+	renewAt  time.Time
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		key:      key,
+		requests: map[string]int{},
+		names:    []string{"kitchen.devices.example.com"},
+		renewAt:  time.Now().Add(30 * 24 * time.Hour),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", s.register)
+	mux.HandleFunc("/v1/certificate", s.certificate)
+	mux.HandleFunc("/v1/renewal_info", s.renewalInfo)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) count(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[path]
+}
+
+func (s *fakeServer) register(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests[r.URL.Path]++
+	writeResponse(w, interop.RegClientResponse{Success: true, Hostname: "kitchen", Names: s.names, RejectedIPs: s.rejected})
+}
+
+func (s *fakeServer) certificate(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests[r.URL.Path]++
+
+	var request interop.CertificateRequest
+	json.NewDecoder(r.Body).Decode(&request)
+	csr, err := x509.ParseCertificateRequest(request.CSR)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeResponse(w, interop.CertificateResponse{Message: err.Error()})
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, s.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeResponse(w, interop.CertificateResponse{Message: err.Error()})
+		return
+	}
+	renewal := &interop.RenewalInfo{RenewAt: s.renewAt}
+	writeResponse(w, interop.CertificateResponse{Success: true, Certificates: [][]byte{der}, Renewal: renewal})
+}
+
+func (s *fakeServer) renewalInfo(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests[r.URL.Path]++
+	writeResponse(w, interop.RenewalInfoResponse{Success: true, Renewal: &interop.RenewalInfo{RenewAt: s.renewAt}})
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *fakeServer) config(events Events) Config {
+	return Config{
+		ServerURL: s.URL,
+		API:       apiclient.Options{HTTPClient: s.Client()},
+		IPs:       []string{"192.168.1.10"},
+		Events:    events,
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	server := newFakeServer(t)
+	server.rejected = []interop.IPRejection{{IP: "203.0.113.5", Reason: "not_allowed"}}
+	store := NewMemoryStore()
+
+	fired := map[string]int{}
+	events := Events{
+		IPRejected:        func(interop.IPRejection) { fired["IPRejected"]++ },
+		Registered:        func(Registration, *interop.RegClientResponse) { fired["Registered"]++ },
+		CSRCreated:        func([]byte) { fired["CSRCreated"]++ },
+		CertificateIssued: func(*x509.Certificate, *interop.CertificateResponse) { fired["CertificateIssued"]++ },
+		CertificateLoaded: func(*x509.Certificate) { fired["CertificateLoaded"]++ },
+	}
+
+	enroller, err := New(server.config(events), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enroller.Enroll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"IPRejected": 1, "Registered": 1, "CSRCreated": 1, "CertificateIssued": 1}
+	if !reflect.DeepEqual(fired, want) {
+		t.Errorf("events %v, want %v", fired, want)
+	}
+	if server.count("/v1/register") != 1 || server.count("/v1/certificate") != 1 {
+		t.Errorf("%d registrations and %d certificate requests, want 1 of each", server.count("/v1/register"), server.count("/v1/certificate"))
+	}
+
+	registration, ok := enroller.Registration()
+	if !ok || registration.Hostname != "kitchen" || !reflect.DeepEqual(registration.Names, server.names) {
+		t.Errorf("registration %+v", registration)
+	}
+	if !registration.RenewAt.Equal(server.renewAt) {
+		t.Errorf("renew at %s, want the server's %s", registration.RenewAt, server.renewAt)
+	}
+	stored, err := store.LoadRegistration()
+	if err != nil || !reflect.DeepEqual(stored, registration) {
+		t.Errorf("stored registration %+v, %v", stored, err)
+	}
+	if _, _, err := store.LoadKeyPair(); err != nil {
+		t.Errorf("the key pair was not stored: %s", err)
+	}
+	certificate, err := enroller.TLSConfig().GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(certificate.Leaf.DNSNames, server.names) {
+		t.Errorf("serving a certificate for %v", certificate.Leaf.DNSNames)
+	}
+}
+
+func TestEnrollStored(t *testing.T) {
+	server := newFakeServer(t)
+	store := NewMemoryStore()
+	first, err := New(server.config(Events{}), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Enroll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	serial := first.Certificate().SerialNumber
+
+	tests := []struct {
+		name         string
+		names        []string
+		certificates int
+		loaded       bool
+	}{
+		// The stored certificate is still good so nothing is asked for
+		{"reused", []string{"kitchen.devices.example.com"}, 1, true},
+		// The server has given the device another name since
+		{"names changed", []string{"kitchen.devices.example.com", "cam7.devices.example.com"}, 2, false},
+	}
+	for _, test := range tests {
+		registration, _ := store.LoadRegistration()
+		registration.Names = test.names
+		store.SaveRegistration(registration)
+
+		loaded := false
+		enroller, err := New(server.config(Events{CertificateLoaded: func(*x509.Certificate) { loaded = true }}), store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := enroller.Enroll(context.Background()); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if server.count("/v1/register") != 1 {
+			t.Errorf("%s: registered %d times", test.name, server.count("/v1/register"))
+		}
+		if got := server.count("/v1/certificate"); got != test.certificates {
+			t.Errorf("%s: %d certificate requests, want %d", test.name, got, test.certificates)
+		}
+		if loaded != test.loaded {
+			t.Errorf("%s: CertificateLoaded fired %t, want %t", test.name, loaded, test.loaded)
+		}
+		certificate := enroller.Certificate()
+		if reissued := certificate.SerialNumber.Cmp(serial) != 0; reissued == test.loaded {
+			t.Errorf("%s: reissued %t", test.name, reissued)
+		}
+		if !sameNames(certificate.DNSNames, test.names) {
+			t.Errorf("%s: certificate for %v, want %v", test.name, certificate.DNSNames, test.names)
+		}
+	}
+}
+
+func TestRenew(t *testing.T) {
+	server := newFakeServer(t)
+	enroller, err := New(server.config(Events{}), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enroller.Renew(context.Background()); err != ErrNotEnrolled {
+		t.Errorf("Renew before Enroll = %v, want %v", err, ErrNotEnrolled)
+	}
+	if server.count("/v1/certificate") != 0 {
+		t.Error("Renew before Enroll asked for a certificate")
+	}
+
+	if err := enroller.Enroll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	serial := enroller.Certificate().SerialNumber
+	if err := enroller.Renew(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if enroller.Certificate().SerialNumber.Cmp(serial) == 0 {
+		t.Error("Renew kept the old certificate")
+	}
+	if server.count("/v1/register") != 1 || server.count("/v1/certificate") != 2 {
+		t.Errorf("%d registrations and %d certificate requests after renewing", server.count("/v1/register"), server.count("/v1/certificate"))
+	}
+}
+
+func TestNewNeedsStore(t *testing.T) {
+	if _, err := New(Config{ServerURL: "https://otsserver.example.com"}, nil); err == nil {
+		t.Error("New worked without a key store")
+	}
+}
@@ -0,0 +1,140 @@
+package enroll
+
+/*
+Keeping the certificate renewed. The server sends the time to renew
+with each certificate, from the CA's renewal information (ARI) where
+it has it, and the CA can move it later so Run asks the server again
+now and then through /v1/renewal_info. Without a time from the server
+the certificate is renewed at the start of the window the server uses
+by default.
+*/
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const (
+	// How often Run asks the server whether the renewal time has moved
+	renewalInfoInterval = 6 * time.Hour
+	// How long Run waits after a failed renewal before trying again
+	renewalRetryWait = 10 * time.Minute
+
+	// As on the server, shorter lived certificates are renewed half way
+	// through rather than two thirds of the way
+	shortLivedLifetime = 10 * 24 * time.Hour
+)
+
+// When the certificate should be renewed, the time from the server if it
+// gave one that is before the certificate expires
+func renewalTime(certificate *x509.Certificate, renewAt time.Time) time.Time {
+	if !renewAt.IsZero() && renewAt.Before(certificate.NotAfter) {
+		return renewAt
+	}
+	lifetime := certificate.NotAfter.Sub(certificate.NotBefore)
+	if lifetime < shortLivedLifetime {
+		return certificate.NotBefore.Add(lifetime / 2)
+	}
+	return certificate.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// When the current certificate should be renewed, zero if there isn't one
+func (e *Enroller) RenewAt() time.Time {
+	certificate := e.certificates.Certificate()
+	if certificate == nil {
+		return time.Time{}
+	}
+	registration, _ := e.Registration()
+	return renewalTime(certificate, registration.RenewAt)
+}
+
+// Asks the server for the current renewal time, the CA may have moved it
+// since the certificate was issued
+func (e *Enroller) RefreshRenewalInfo(ctx context.Context) error {
+	registration, ok := e.Registration()
+	if !ok {
+		return ErrNotEnrolled
+	}
+	response, err := e.api.RenewalInfo(ctx, registration.ClientID)
+	if err != nil {
+		return err
+	}
+	if response.Renewal == nil || response.Renewal.RenewAt.Equal(registration.RenewAt) {
+		return nil
+	}
+	log.Debugf("The server moved the renewal time to %s", response.Renewal.RenewAt)
+
+	// Enroll or Renew could have replaced the registration while the
+	// request was out
+	e.running.Lock()
+	defer e.running.Unlock()
+	current, _ := e.Registration()
+	if current.ClientID != registration.ClientID || !current.RenewAt.Equal(registration.RenewAt) {
+		return nil
+	}
+	current.RenewAt = response.Renewal.RenewAt
+	return e.setRegistration(current)
+}
+
+// Renews the certificate at its renewal time until the context is done.
+// Enroll must have been called first. A failed renewal is tried again
+// after a few minutes, the old certificate is served until one works.
+func (e *Enroller) Run(ctx context.Context) {
+	for {
+		renewAt := e.RenewAt()
+		if renewAt.IsZero() {
+			// Nothing to renew until Enroll has a certificate
+			renewAt = time.Now().Add(renewalRetryWait)
+		}
+		wait := time.Until(renewAt)
+		refresh := wait > renewalInfoInterval
+		if refresh {
+			wait = renewalInfoInterval
+		}
+		log.Debugf("Next renewal at %s", renewAt)
+		if !sleep(ctx, wait) {
+			return
+		}
+
+		if refresh {
+			if err := e.RefreshRenewalInfo(ctx); err != nil {
+				log.Debugf("Could not refresh the renewal information: %s", err)
+			}
+			continue
+		}
+		if e.Certificate() == nil {
+			continue
+		}
+
+		log.Printf("Renewing the certificate")
+		err := e.Renew(ctx)
+		if err != nil {
+			log.Printf("Could not renew the certificate, trying again in %s, error: %s", renewalRetryWait, err)
+			if e.config.Events.RenewalFailed != nil {
+				e.config.Events.RenewalFailed(err)
+			}
+		}
+		// A server which keeps saying to renew straight away shouldn't
+		// have the client renewing in a tight loop
+		if err != nil || !e.RenewAt().After(time.Now()) {
+			if !sleep(ctx, renewalRetryWait) {
+				return
+			}
+		}
+	}
+}
+
+// False if the context finished first
+func sleep(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,136 @@
+package enroll
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	certificate := func(lifetime time.Duration) *x509.Certificate {
+		return &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(lifetime)}
+	}
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		renewAt  time.Time
+		want     time.Time
+	}{
+		{"90 days", 90 * day, time.Time{}, notBefore.Add(60 * day)},
+		{"6 days", 6 * day, time.Time{}, notBefore.Add(3 * day)},
+		{"from the server", 90 * day, notBefore.Add(45 * day), notBefore.Add(45 * day)},
+		// Left over from an older certificate
+		{"after expiry", 6 * day, notBefore.Add(60 * day), notBefore.Add(3 * day)},
+	}
+	for _, test := range tests {
+		if got := renewalTime(certificate(test.lifetime), test.renewAt); !got.Equal(test.want) {
+			t.Errorf("%s: renewalTime = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStillGood(t *testing.T) {
+	now := time.Now()
+	names := []string{"a.example.com", "b.example.com"}
+	certificate := func(age time.Duration, lifetime time.Duration, names ...string) *x509.Certificate {
+		return &x509.Certificate{NotBefore: now.Add(-age), NotAfter: now.Add(lifetime - age), DNSNames: names}
+	}
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		certificate *x509.Certificate
+		renewAt     time.Time
+		want        bool
+	}{
+		{"no certificate", nil, time.Time{}, false},
+		{"fresh", certificate(day, 90*day, "b.example.com", "a.example.com"), time.Time{}, true},
+		{"names changed", certificate(day, 90*day, "a.example.com"), time.Time{}, false},
+		{"two thirds through", certificate(61*day, 90*day, names...), time.Time{}, false},
+		// A third of its life left, but past half way for a short lived one
+		{"short lived", certificate(4*day, 6*day, names...), time.Time{}, false},
+		{"server says wait", certificate(61*day, 90*day, names...), now.Add(day), true},
+		{"server says renew", certificate(day, 90*day, names...), now.Add(-time.Minute), false},
+	}
+	for _, test := range tests {
+		registration := Registration{Names: names, RenewAt: test.renewAt}
+		if got := stillGood(test.certificate, registration); got != test.want {
+			t.Errorf("%s: stillGood = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRefreshRenewalInfo(t *testing.T) {
+	server := newFakeServer(t)
+	store := NewMemoryStore()
+	enroller, err := New(server.config(Events{}), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enroller.RefreshRenewalInfo(context.Background()); err != ErrNotEnrolled {
+		t.Errorf("RefreshRenewalInfo before Enroll = %v, want %v", err, ErrNotEnrolled)
+	}
+	if err := enroller.Enroll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The CA has brought the renewal forward
+	moved := time.Now().Add(2 * 24 * time.Hour).Truncate(time.Second)
+	server.mutex.Lock()
+	server.renewAt = moved
+	server.mutex.Unlock()
+
+	if err := enroller.RefreshRenewalInfo(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.count("/v1/renewal_info") != 1 {
+		t.Errorf("%d renewal information requests, want 1", server.count("/v1/renewal_info"))
+	}
+	if got := enroller.RenewAt(); !got.Equal(moved) {
+		t.Errorf("RenewAt = %s, want %s", got, moved)
+	}
+	if stored, _ := store.LoadRegistration(); !stored.RenewAt.Equal(moved) {
+		t.Errorf("stored renew at %s, want %s", stored.RenewAt, moved)
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := newFakeServer(t)
+	// Renew as soon as it is issued, every time
+	server.renewAt = time.Now().Add(-time.Minute)
+	enroller, err := New(server.config(Events{}), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enroller.Enroll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		enroller.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for server.count("/v1/certificate") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Given time to go round again, it should be waiting instead
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop when the context was cancelled")
+	}
+
+	if got := server.count("/v1/certificate"); got != 2 {
+		t.Errorf("%d certificate requests, want the enrollment and one renewal", got)
+	}
+}
@@ -0,0 +1,172 @@
+package enroll
+
+/*
+Where the Enroller keeps what it needs between runs. The key pair is
+kept as PEM so it can be handed straight to tls.X509KeyPair, the
+certificate file has the leaf first then the chain.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Returned by the Load methods when nothing has been saved yet
+var ErrNotStored = errors.New("Nothing has been stored")
+
+// What the device was given when it registered
+type Registration struct {
+	ClientID string `json:"clientID"`
+	Hostname string `json:"hostname"`
+	// The names which must be in the certificate
+	Names []string `json:"names"`
+	// When the server said to renew the current certificate, zero if it
+	// didn't say
+	RenewAt time.Time `json:"renewAt"`
+}
+
+type KeyStore interface {
+	LoadRegistration() (Registration, error)
+	SaveRegistration(registration Registration) error
+	LoadKeyPair() (certPEM []byte, keyPEM []byte, err error)
+	SaveKeyPair(certPEM []byte, keyPEM []byte) error
+}
+
+// Keeps everything in files. If RegistrationFile is empty the
+// registration isn't kept and the device registers again on each run.
+type FileStore struct {
+	CertFile         string
+	KeyFile          string
+	RegistrationFile string
+}
+
+func NewFileStore(certFile string, keyFile string, registrationFile string) *FileStore {
+	return &FileStore{CertFile: certFile, KeyFile: keyFile, RegistrationFile: registrationFile}
+}
+
+func (s *FileStore) LoadRegistration() (Registration, error) {
+	var registration Registration
+	if s.RegistrationFile == "" {
+		return registration, ErrNotStored
+	}
+	js, err := ioutil.ReadFile(s.RegistrationFile)
+	if os.IsNotExist(err) {
+		return registration, ErrNotStored
+	}
+	if err != nil {
+		return registration, err
+	}
+	err = json.Unmarshal(js, &registration)
+	return registration, err
+}
+
+func (s *FileStore) SaveRegistration(registration Registration) error {
+	if s.RegistrationFile == "" {
+		return nil
+	}
+	js, err := json.MarshalIndent(registration, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(s.RegistrationFile, js, 0600)
+}
+
+func (s *FileStore) LoadKeyPair() ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(s.CertFile)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotStored
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(s.KeyFile)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotStored
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// The key goes first so anything watching the certificate file sees the
+// new certificate after its key is in place
+func (s *FileStore) SaveKeyPair(certPEM []byte, keyPEM []byte) error {
+	if err := writeFile(s.KeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeFile(s.CertFile, certPEM, 0644)
+}
+
+// Written to a temporary file then renamed over the old one so a reader
+// never sees half a file
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// For devices which keep their secrets somewhere of their own, or don't
+// keep them at all
+type MemoryStore struct {
+	mutex        sync.Mutex
+	registration *Registration
+	certPEM      []byte
+	keyPEM       []byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) LoadRegistration() (Registration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.registration == nil {
+		return Registration{}, ErrNotStored
+	}
+	return *s.registration, nil
+}
+
+func (s *MemoryStore) SaveRegistration(registration Registration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registration = &registration
+	return nil
+}
+
+func (s *MemoryStore) LoadKeyPair() ([]byte, []byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.certPEM == nil {
+		return nil, nil, ErrNotStored
+	}
+	return s.certPEM, s.keyPEM, nil
+}
+
+func (s *MemoryStore) SaveKeyPair(certPEM []byte, keyPEM []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certPEM = certPEM
+	s.keyPEM = keyPEM
+	return nil
+}
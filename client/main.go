@@ -1,18 +1,20 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/x509"
 	"encoding/pem" // needed for debug writing out csr
 	"flag"
 	"fmt"
 	"github.com/digininja/ots-cert-demo/client/config"
+	"github.com/digininja/ots-cert-demo/client/enroll"
 	"github.com/digininja/ots-cert-demo/interop"
-	"github.com/google/uuid"
+	"github.com/digininja/ots-cert-demo/interop/apiclient"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 import log "github.com/sirupsen/logrus"
 
@@ -80,13 +82,13 @@ func main() {
 		interfaceName = *interfaceNamePtr
 		log.Debugf("Forcing the use of the interface: %s", interfaceName)
 	}
-	ip := interop.GetIP(interfaceName)
-
 	log.Debugf("Client registration URL: %s", Cfg.ClientRegistrationURL)
 	log.Debugf("Certificate request URL: %s", Cfg.CertificateRequestURL)
+	log.Debugf("Renewal info URL: %s", Cfg.RenewalInfoURL)
 	log.Debugf("Certificate filename: %s", Cfg.CertFilename)
 	log.Debugf("Private key filename: %s", Cfg.KeyFilename)
 	log.Debugf("CSR filename: %s", Cfg.CSRFilename)
+	log.Debugf("Registration filename: %s", Cfg.RegistrationFilename)
 
 	/*
 		// To start the web server with an existing certificate/key pair
@@ -94,112 +96,134 @@ func main() {
 		StartWebServer("infallible-mayer.ots-cert.space", Cfg.WebServer.Port)
 		os.Exit(100)
 	*/
-	uuid := uuid.New()
-	clientID := uuid.String()
-	log.Debugf("UUID: %s", clientID)
-
-	regClientRequest := interop.RegClientRequest{ClientID: clientID, IP: ip}
-	js, err := json.Marshal(regClientRequest)
+	apiOptions, err := newAPIOptions()
 	if err != nil {
-		log.Fatalf(fmt.Sprintf("Error marshalling the JSON request: %s", err.Error()))
-		return
-	}
-
-	/*
-		// From here: https://golang.org/pkg/net/http/
-		// If you need to fiddle with connection settings, create this and then use it like:
-		// client := &http.Client{Transport: tr}
-
-		tr := &http.Transport{
-			MaxIdleConns:       10,
-			IdleConnTimeout:    30 * time.Second,
-			DisableCompression: true,
-		}
-	*/
-
-	req, err := http.NewRequest("POST", Cfg.ClientRegistrationURL, bytes.NewBuffer(js))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+		log.Fatalf("Could not set up the API client: %s", err)
+	}
+
+	enrollConfig := enroll.Config{
+		API:             apiOptions,
+		EnrollmentToken: Cfg.EnrollmentToken,
+		Serial:          Cfg.Serial,
+		Model:           Cfg.Model,
+		Hostname:        Cfg.Hostname,
+		Alias:           Cfg.Alias,
+		IPPolicy: interop.IPPolicy{
+			Interface:      interfaceName,
+			Allow:          Cfg.IPSelection.Allow,
+			Deny:           Cfg.IPSelection.Deny,
+			SkipInterfaces: Cfg.IPSelection.SkipInterfaces,
+		},
+		CSRSubject: Cfg.CSRSubject,
+		Events:     enrollEvents(),
+	}
+	store := enroll.NewFileStore(Cfg.CertFilename, Cfg.KeyFilename, Cfg.RegistrationFilename)
+
+	enroller, err := enroll.New(enrollConfig, store)
 	if err != nil {
-		log.Fatalf("Could not connect to server, error: %s", err)
+		log.Fatalf("Could not set up the enrollment: %s", err)
 	}
-	defer resp.Body.Close()
-
-	log.Debugf("Response Status: %s\n", resp.Status)
-
-	log.Debugf("Response Headers:", resp.Header)
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Debugf("Response Body: %s\n", string(body))
-
-	var regClientResponse interop.RegClientResponse
-	err = json.Unmarshal(body, &regClientResponse)
-
-	if !regClientResponse.Success {
-		log.Fatalf(fmt.Sprintf("Could not register the client, error: %s", regClientResponse.Message))
+	if err := enroller.Enroll(context.Background()); err != nil {
+		logAPIError(err)
+		log.Fatalf("Could not enroll the client, error: %s", err)
 	}
-	log.Printf("The hostname is: %s", regClientResponse.Hostname)
 
-	// Generate the key and CSR and request the certificate
+	// The renewed files are picked up by the web server's certificate
+	// manager
+	log.Printf("The certificate will be renewed at %s", enroller.RenewAt())
+	go enroller.Run(context.Background())
 
-	log.Debug("Generating the private key")
-	log.Debugf("Writing private key to: %s", Cfg.KeyFilename)
+	registration, _ := enroller.Registration()
+	StartWebServer(registration.Hostname, Cfg.WebServer.Port)
+}
 
-	privateKeyBytes, err := interop.GeneratePrivateKey(Cfg.KeyFilename)
-	if err != nil {
-		log.Fatalf("Could not generate the private key: %s", err.Error())
-	}
-	log.Debug("Generating the CSR")
-	csr, err := interop.GenerateCSR(Cfg.CSRFilename, regClientResponse.Hostname, privateKeyBytes)
-	if err != nil {
-		log.Fatalf("Could not generate the CSR: %s", err.Error())
+// The URLs in the config are used as they are so older servers with
+// different paths still work
+func newAPIOptions() (apiclient.Options, error) {
+	options := apiclient.Options{
+		MaxRetries:   Cfg.MaxRetries,
+		MaxRetryWait: time.Duration(Cfg.MaxRetryWait) * time.Second,
+		Endpoints: apiclient.Endpoints{
+			Register:    Cfg.ClientRegistrationURL,
+			Certificate: Cfg.CertificateRequestURL,
+			RenewalInfo: Cfg.RenewalInfoURL,
+		},
+	}
+	if options.Endpoints.RenewalInfo == "" {
+		certificateURL, err := url.Parse(Cfg.CertificateRequestURL)
+		if err != nil {
+			return options, err
+		}
+		options.Endpoints.RenewalInfo = certificateURL.ResolveReference(&url.URL{Path: "renewal_info"}).String()
 	}
-
-	certificateRequest := interop.CertificateRequest{ClientID: clientID, CSR: csr}
-	js, err = json.Marshal(certificateRequest)
-	if err != nil {
-		log.Fatalf(fmt.Sprintf("Error marshalling the JSON request: %s", err.Error()))
-		return
+	if Cfg.MaxRetries == 0 {
+		options.MaxRetries = -1
 	}
-
-	req, err = http.NewRequest("POST", Cfg.CertificateRequestURL, bytes.NewBuffer(js))
-	req.Header.Set("Content-Type", "application/json")
-
-	client = &http.Client{}
-	resp, err = client.Do(req)
-	if err != nil {
-		panic(err)
+	if Cfg.StagingRoots != "" {
+		log.Debugf("Adding the staging roots from: %s", Cfg.StagingRoots)
+		roots, err := apiclient.LoadRoots(Cfg.StagingRoots)
+		if err != nil {
+			return options, err
+		}
+		options.RootCAs = roots
 	}
-	defer resp.Body.Close()
-
-	log.Debugf("Response Status: %s\n", resp.Status)
-	//log.Printf("response Headers:", resp.Header)
-	body, _ = ioutil.ReadAll(resp.Body)
-	log.Debugf("Response Body: %s\n", string(body))
-
-	var certificateResponse interop.CertificateResponse
-	err = json.Unmarshal(body, &certificateResponse)
+	return options, nil
+}
 
-	if !certificateResponse.Success {
-		log.Fatalf("There was a problem generating the certificate: %s", certificateResponse.Message)
+func enrollEvents() enroll.Events {
+	return enroll.Events{
+		IPRejected: func(rejection interop.IPRejection) {
+			log.Printf("The server did not accept the IP address %s (%s): %s", rejection.IP, rejection.Reason, rejection.Detail)
+		},
+		Registered: func(registration enroll.Registration, response *interop.RegClientResponse) {
+			if response.SubstitutionReason != "" {
+				log.Printf("The requested hostname was not used: %s", response.SubstitutionReason)
+			}
+			log.Printf("The hostname is: %s", registration.Hostname)
+			for _, refusal := range response.RefusedNames {
+				log.Printf("The server did not give the name %s: %s", refusal.Name, refusal.Reason)
+			}
+			log.Debugf("Names for the certificate: %s", strings.Join(registration.Names, ", "))
+		},
+		CSRCreated: func(csr []byte) {
+			if Cfg.CSRFilename == "" {
+				return
+			}
+			log.Debugf("Writing the CSR to: %s", Cfg.CSRFilename)
+			csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+			if err := ioutil.WriteFile(Cfg.CSRFilename, csrPEM, 0644); err != nil {
+				log.Printf("Could not write the CSR to %s: %s", Cfg.CSRFilename, err)
+			}
+		},
+		CertificateIssued: func(certificate *x509.Certificate, response *interop.CertificateResponse) {
+			log.Print("The certificate was generated")
+			if response.Staging {
+				log.Print("The certificate is from a staging CA and will not be trusted by browsers")
+			}
+			if response.Profile != "" {
+				log.Printf("The certificate has the %s profile", response.Profile)
+			}
+			if renewal := response.Renewal; renewal != nil {
+				log.Printf("Renew the certificate at %s, the window is %s to %s", renewal.RenewAt, renewal.WindowStart, renewal.WindowEnd)
+				if renewal.ExplanationURL != "" {
+					log.Printf("The CA has explained the window at: %s", renewal.ExplanationURL)
+				}
+			}
+		},
+		CertificateLoaded: func(certificate *x509.Certificate) {
+			log.Printf("Using the existing certificate, it expires at %s", certificate.NotAfter)
+		},
 	}
-	log.Print("The certificate was generated")
-	log.Debugf("Writing the certificate to: %s", Cfg.CertFilename)
+}
 
-	certOut, err := os.Create(Cfg.CertFilename)
-	if err != nil {
-		log.Fatalf("Failed to open %s for writing: %s", Cfg.CertFilename, err)
-	}
-	for _, certificate := range certificateResponse.Certificates {
-		if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certificate}); err != nil {
-			log.Fatalf("Failed to write data to %s: %s", Cfg.CertFilename, err)
-		}
+// Servers before /v1/ don't send an error code
+func logAPIError(err error) {
+	apiError, ok := err.(*apiclient.Error)
+	if !ok || apiError.Code == "" {
+		return
 	}
-	if err := certOut.Close(); err != nil {
-		log.Fatalf("Error closing %s, : %s", Cfg.CertFilename, err)
+	log.Printf("The server returned the error code %s", apiError.Code)
+	if apiError.Retryable {
+		log.Print("The error may go away if the client is run again later")
 	}
-	log.Debug("Wrote certificate")
-
-	StartWebServer(regClientResponse.Hostname, Cfg.WebServer.Port)
 }
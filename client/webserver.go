@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
+	"github.com/digininja/ots-cert-demo/client/certmanager"
 	"net/http"
+	"time"
 )
 import log "github.com/sirupsen/logrus"
 
@@ -12,14 +16,29 @@ func HelloServer(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte("Congratulations, you should be viewing this over HTTPS on your custom domain.\n"))
 }
 
+// The certificate files are watched so a renewal is served without a
+// restart
 func StartWebServer(hostname string, port int) {
 	listenOn := fmt.Sprintf("%s:%d", hostname, port)
 	log.Debug("Starting the web server")
-	log.Printf("Setup complete, browse to https://%s", listenOn)
-	http.HandleFunc("/", HelloServer)
-	err := http.ListenAndServeTLS(listenOn, Cfg.CertFilename, Cfg.KeyFilename, nil)
 	log.Debugf("Certificate filename: %s", Cfg.CertFilename)
 	log.Debugf("Private key filename: %s", Cfg.KeyFilename)
+
+	manager, err := certmanager.New(Cfg.CertFilename, Cfg.KeyFilename, certmanager.Options{
+		Interval: time.Duration(Cfg.WebServer.ReloadInterval) * time.Second,
+		OnReload: func(certificate *x509.Certificate) {
+			log.Printf("Serving the certificate which expires at %s", certificate.NotAfter)
+		},
+	})
+	if err != nil {
+		log.Fatalf("Could not load the certificate, error: %s", err)
+	}
+	go manager.Watch(context.Background())
+
+	log.Printf("Setup complete, browse to https://%s", listenOn)
+	http.HandleFunc("/", HelloServer)
+	server := &http.Server{Addr: listenOn, TLSConfig: manager.TLSConfig()}
+	err = server.ListenAndServeTLS("", "")
 	if err != nil {
 		log.Fatalf("There was a problem starting the web server, error: ", err)
 	}
@@ -0,0 +1,381 @@
+package apiclient
+
+/*
+A client for the server's /v1/ API, for firmware which talks to the
+server itself rather than running the client binary. The protocol is
+described in interop/openapi.yaml.
+
+	api, err := apiclient.New("https://otsserver.example.com:9443", apiclient.Options{})
+	reg, err := api.Register(ctx, interop.RegClientRequest{ClientID: id, IPs: ips})
+	cert, err := api.RequestCertificate(ctx, id, csr)
+
+If the server is rate limiting, the request is sent again after the
+Retry-After it gives, up to Options.MaxRetries times. A certificate
+request the server has queued is polled until it is done, these polls
+don't count as retries. Either way a wait longer than
+Options.MaxRetryWait is a failure.
+
+Failures reported by the server come back as *Error along with the
+decoded response, which for some calls has more detail such as the
+rejected IP addresses.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const (
+	DefaultMaxRetries   = 5
+	DefaultMaxRetryWait = time.Hour
+	// Certificates are issued while the request waits so this needs to
+	// allow for DNS propagation and the CA
+	DefaultTimeout = 5 * time.Minute
+
+	// Used if the server sends a 429 without a usable Retry-After
+	defaultRetryAfter = 30 * time.Second
+	// Waits between attempts when the server can't be reached
+	networkRetryWait = 5 * time.Second
+
+	maxResponseBytes = 1 << 20
+)
+
+// The paths of the endpoints, relative to the base URL unless they are
+// absolute URLs. Anything left empty gets the /v1/ path.
+type Endpoints struct {
+	Register    string
+	Certificate string
+	RenewalInfo string
+	UpdateIP    string
+}
+
+type Options struct {
+	// Used as it is if set, the TLS options are then ignored
+	HTTPClient *http.Client
+	// Roots to trust for the server's certificate instead of the system
+	// ones, see LoadRoots
+	RootCAs *x509.CertPool
+	// Any other TLS settings, RootCAs overrides the one in here
+	TLSConfig *tls.Config
+	// For each attempt, DefaultTimeout if zero
+	Timeout time.Duration
+	// DefaultMaxRetries if zero, negative turns retries off
+	MaxRetries int
+	// DefaultMaxRetryWait if zero
+	MaxRetryWait time.Duration
+	Endpoints    Endpoints
+}
+
+type Client struct {
+	base         *url.URL
+	httpClient   *http.Client
+	maxRetries   int
+	maxRetryWait time.Duration
+	endpoints    Endpoints
+}
+
+// A failure reported by the server. Servers before /v1/ don't send a
+// code, only the message.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Retryable  bool
+	// From the Retry-After header, zero if there wasn't one
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("The server returned %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("The server returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// The base URL can be empty if all the endpoints are absolute URLs
+func New(baseURL string, options Options) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("The base URL is not valid: %s", err))
+	}
+
+	c := &Client{
+		base:         base,
+		httpClient:   options.HTTPClient,
+		maxRetries:   options.MaxRetries,
+		maxRetryWait: options.MaxRetryWait,
+		endpoints:    options.Endpoints,
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultMaxRetries
+	}
+	if c.maxRetries < 0 {
+		c.maxRetries = 0
+	}
+	if c.maxRetryWait == 0 {
+		c.maxRetryWait = DefaultMaxRetryWait
+	}
+	if c.endpoints.Register == "" {
+		c.endpoints.Register = "/v1/register"
+	}
+	if c.endpoints.Certificate == "" {
+		c.endpoints.Certificate = "/v1/certificate"
+	}
+	if c.endpoints.RenewalInfo == "" {
+		c.endpoints.RenewalInfo = "/v1/renewal_info"
+	}
+	if c.endpoints.UpdateIP == "" {
+		c.endpoints.UpdateIP = "/v1/update_ip"
+	}
+
+	if c.httpClient == nil {
+		timeout := options.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		tlsConfig := &tls.Config{}
+		if options.TLSConfig != nil {
+			tlsConfig = options.TLSConfig.Clone()
+		}
+		if options.RootCAs != nil {
+			tlsConfig.RootCAs = options.RootCAs
+		}
+		c.httpClient = &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	return c, nil
+}
+
+// The system roots plus the ones in the PEM file, for a server with a
+// certificate from a staging CA
+func LoadRoots(filename string) (*x509.CertPool, error) {
+	rootsPEM, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", filename))
+	}
+	return pool, nil
+}
+
+// Registers the client and creates the DNS records for it. IP is filled
+// in from IPs if it is empty, for servers which only read IP.
+func (c *Client) Register(ctx context.Context, request interop.RegClientRequest) (*interop.RegClientResponse, error) {
+	if request.IP == "" {
+		request.IP = interop.FirstIPv4(request.IPs)
+	}
+	var response interop.RegClientResponse
+	// Sending the registration again after a network error could register
+	// the client twice, so only retry when the server says to
+	err := c.post(ctx, c.endpoints.Register, request, &response, false)
+	return &response, err
+}
+
+// The CSR must have exactly the names from the registration response
+func (c *Client) RequestCertificate(ctx context.Context, clientID string, csr []byte) (*interop.CertificateResponse, error) {
+	var response interop.CertificateResponse
+	err := c.post(ctx, c.endpoints.Certificate, interop.CertificateRequest{ClientID: clientID, CSR: csr}, &response, true)
+	return &response, err
+}
+
+// A new certificate for a client which already has one. It is asked for
+// the same way as the first, the CSR should be for a new key.
+func (c *Client) Renew(ctx context.Context, clientID string, csr []byte) (*interop.CertificateResponse, error) {
+	return c.RequestCertificate(ctx, clientID, csr)
+}
+
+// When the current certificate should be renewed, the CA can move this
+// after the certificate is issued
+func (c *Client) RenewalInfo(ctx context.Context, clientID string) (*interop.RenewalInfoResponse, error) {
+	var response interop.RenewalInfoResponse
+	err := c.post(ctx, c.endpoints.RenewalInfo, interop.RenewalInfoRequest{ClientID: clientID}, &response, true)
+	return &response, err
+}
+
+// Replaces the addresses published for all the client's names
+func (c *Client) UpdateIP(ctx context.Context, clientID string, ips []string) (*interop.UpdateIPResponse, error) {
+	var response interop.UpdateIPResponse
+	err := c.post(ctx, c.endpoints.UpdateIP, interop.UpdateIPRequest{ClientID: clientID, IPs: ips}, &response, true)
+	return &response, err
+}
+
+func (c *Client) endpointURL(endpoint string) (string, error) {
+	ref, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if ref.IsAbs() {
+		return ref.String(), nil
+	}
+	if !c.base.IsAbs() {
+		return "", errors.New(fmt.Sprintf("No base URL to use with %s", endpoint))
+	}
+	return c.base.ResolveReference(ref).String(), nil
+}
+
+// Sends the request and decodes the answer into response, which is
+// filled in even if an error is returned
+func (c *Client) post(ctx context.Context, endpoint string, request interface{}, response interface{}, retryNetwork bool) error {
+	target, err := c.endpointURL(endpoint)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	attempt := 0
+	for {
+		status, header, body, err := c.send(ctx, target, js)
+		if err != nil {
+			if !retryNetwork || attempt >= c.maxRetries || ctx.Err() != nil {
+				return err
+			}
+			attempt++
+			log.Printf("Could not reach the server, trying again in %s, error: %s", networkRetryWait, err)
+			if err := sleep(ctx, networkRetryWait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		wait := retryAfter(header.Get("Retry-After"))
+
+		if status == http.StatusAccepted {
+			// The response says the request is queued, the caller can
+			// come back for it after RetryAfter
+			if wait > c.maxRetryWait {
+				log.Printf("The server asked to wait %s for the queued request which is longer than the maximum of %s", wait, c.maxRetryWait)
+				apiErr := decodeResponse(status, body, response)
+				apiErr.RetryAfter = wait
+				return apiErr
+			}
+			log.Printf("The request has been queued by the server, checking again in %s", wait)
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		apiErr := decodeResponse(status, body, response)
+		if apiErr == nil {
+			return nil
+		}
+		if header.Get("Retry-After") != "" {
+			apiErr.RetryAfter = wait
+		}
+		if !retryable(status) || attempt >= c.maxRetries {
+			return apiErr
+		}
+		if wait > c.maxRetryWait {
+			log.Printf("The server asked to wait %s which is longer than the maximum of %s", wait, c.maxRetryWait)
+			return apiErr
+		}
+		attempt++
+		log.Printf("The server is busy, trying again in %s", wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, target string, js []byte) (int, http.Header, []byte, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(js))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "ots-cert-apiclient/"+interop.Version)
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	log.Debugf("Response Status: %s", resp.Status)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	log.Debugf("Response Body: %s", string(body))
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// Only these are worth sending again without any change
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+func decodeResponse(status int, body []byte, response interface{}) *Error {
+	// Every response has success and message so this works whatever the
+	// endpoint
+	var result interop.ErrorResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return &Error{StatusCode: status, Message: fmt.Sprintf("The response could not be decoded: %s", err)}
+	}
+	json.Unmarshal(body, response)
+
+	if status == http.StatusOK && result.Success {
+		return nil
+	}
+	apiErr := &Error{StatusCode: status, Message: result.Message}
+	if result.Error != nil {
+		apiErr.Code = result.Error.Code
+		apiErr.Retryable = result.Error.Retryable
+		if result.Error.Message != "" {
+			apiErr.Message = result.Error.Message
+		}
+	}
+	return apiErr
+}
+
+// Retry-After can either be a number of seconds or an HTTP date
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+func sleep(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,136 @@
+package apiclient
+
+import (
+	"context"
+	"github.com/digininja/ots-cert-demo/interop"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+	body       string
+}
+
+const (
+	okBody      = `{"success":true,"message":"ok"}`
+	busyBody    = `{"success":false,"message":"busy","error":{"code":"rate_limited","message":"Slow down","retryable":true}}`
+	queuedBody  = `{"success":false,"message":"queued"}`
+	invalidBody = `{"success":false,"message":"bad","error":{"code":"invalid_client_id","message":"Bad client ID"}}`
+)
+
+// A server which gives the responses in turn then keeps giving the last
+// one, and counts the requests
+func scriptedServer(t *testing.T, responses []scriptedResponse) (*httptest.Server, func() int) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		response := responses[len(responses)-1]
+		if requests < len(responses) {
+			response = responses[requests]
+		}
+		requests++
+		mutex.Unlock()
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type is %q", r.Header.Get("Content-Type"))
+		}
+		if response.retryAfter != "" {
+			w.Header().Set("Retry-After", response.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+}
+
+func TestPostRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		responses  []scriptedResponse
+		requests   int
+		code       string
+		status     int
+	}{
+		{"success", 0, []scriptedResponse{{200, "", okBody}}, 1, "", 0},
+		{"retried then success", 0, []scriptedResponse{{429, "0", busyBody}, {503, "0", busyBody}, {200, "", okBody}}, 3, "", 0},
+		{"retries used up", 2, []scriptedResponse{{429, "0", busyBody}}, 3, interop.ErrRateLimited, 429},
+		{"retries off", -1, []scriptedResponse{{429, "0", busyBody}}, 1, interop.ErrRateLimited, 429},
+		{"wait too long", 0, []scriptedResponse{{429, "3600", busyBody}}, 1, interop.ErrRateLimited, 429},
+		{"not retryable", 0, []scriptedResponse{{400, "0", invalidBody}}, 1, interop.ErrInvalidClientID, 400},
+		{"queued then success", 0, []scriptedResponse{{202, "0", queuedBody}, {202, "0", queuedBody}, {200, "", okBody}}, 3, "", 0},
+		{"queued too long", 0, []scriptedResponse{{202, "0", queuedBody}, {202, "3600", queuedBody}}, 2, "", 202},
+	}
+	for _, test := range tests {
+		server, requests := scriptedServer(t, test.responses)
+		client, err := New(server.URL, Options{HTTPClient: server.Client(), MaxRetries: test.maxRetries, MaxRetryWait: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := client.RenewalInfo(context.Background(), "abc")
+		if got := requests(); got != test.requests {
+			t.Errorf("%s: %d requests, want %d", test.name, got, test.requests)
+		}
+		if test.status == 0 {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if !response.Success {
+				t.Errorf("%s: the response was not decoded: %+v", test.name, response)
+			}
+			continue
+		}
+		apiErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: error %v is not an *Error", test.name, err)
+			continue
+		}
+		if apiErr.Code != test.code || apiErr.StatusCode != test.status {
+			t.Errorf("%s: error %d %s, want %d %s", test.name, apiErr.StatusCode, apiErr.Code, test.status, test.code)
+		}
+	}
+}
+
+func TestPostCancelled(t *testing.T) {
+	server, _ := scriptedServer(t, []scriptedResponse{{202, "1", queuedBody}})
+	client, err := New(server.URL, Options{HTTPClient: server.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.RenewalInfo(ctx, "abc"); err != context.DeadlineExceeded {
+		t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"0", 0},
+		{"30", 30 * time.Second},
+		{"", defaultRetryAfter},
+		{"-5", defaultRetryAfter},
+		{"soon", defaultRetryAfter},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.header); got != test.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", test.header, got, test.want)
+		}
+	}
+}
@@ -11,10 +11,11 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 import log "github.com/sirupsen/logrus"
@@ -29,55 +30,59 @@ func GeneratePrivateKey(fileName string) (*rsa.PrivateKey, error) {
 	defer outFile.Close()
 
 	keyBytes, _ := rsa.GenerateKey(rand.Reader, BIT_SIZE)
-	var privateKey = &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(keyBytes),
-	}
 
-	err = pem.Encode(outFile, privateKey)
+	_, err = outFile.Write(EncodePrivateKey(keyBytes))
 	if err != nil {
 		log.Fatalf("Failed to save private key file, error: ", err)
 	}
 	return keyBytes, nil
 }
 
-func GenerateCSR(filename string, domainName string, keyBytes *rsa.PrivateKey) ([]byte, error) {
+// PEM in the same form GeneratePrivateKey writes it, which
+// tls.X509KeyPair can read
+func EncodePrivateKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+// Subject fields for the CSR, empty ones are left out
+type CSRSubject struct {
+	Country            []string
+	Province           []string
+	Locality           []string
+	Organization       []string
+	OrganizationalUnit []string
+}
+
+// For the config dumps
+func (s CSRSubject) Dump() {
+	log.Printf("CSR country: %s", strings.Join(s.Country, ", "))
+	log.Printf("CSR province: %s", strings.Join(s.Province, ", "))
+	log.Printf("CSR locality: %s", strings.Join(s.Locality, ", "))
+	log.Printf("CSR organization: %s", strings.Join(s.Organization, ", "))
+	log.Printf("CSR organizational unit: %s", strings.Join(s.OrganizationalUnit, ", "))
+}
+
+// The CommonName can't be longer than this
+const maxCommonNameLength = 64
+
+// The names all go in the SAN extension, the first is also used as the
+// CommonName if it fits. Wildcards such as *.host.example.com can be
+// included.
+func GenerateCSR(filename string, names []string, subject CSRSubject, keyBytes *rsa.PrivateKey) ([]byte, error) {
+	csrBytes, err := CreateCSR(names, subject, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	outFile, err := os.Create(filename)
 	if err != nil {
 		log.Fatalf("Failed to create CSR file, error: ", err)
 	}
 	defer outFile.Close()
 
-	subj := pkix.Name{
-		CommonName:         domainName,
-		Country:            []string{"GB"},
-		Province:           []string{""},
-		Locality:           []string{"The Internet"},
-		Organization:       []string{"DigiNinja"},
-		OrganizationalUnit: []string{"Hacking"},
-	}
-	rawSubj := subj.ToRDNSequence()
-
-	/*
-		// Email address now allowed on this type of certificate
-
-		var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
-		emailAddress := "robin@digi.ninja"
-		rawSubj = append(rawSubj, []pkix.AttributeTypeAndValue{
-			{Type: oidEmailAddress, Value: emailAddress},
-		})
-	*/
-	asn1Subj, _ := asn1.Marshal(rawSubj)
-	template := x509.CertificateRequest{
-		RawSubject: asn1Subj,
-		//EmailAddresses:     []string{emailAddress},
-		SignatureAlgorithm: x509.SHA256WithRSA,
-	}
-
-	csrBytes, _ := x509.CreateCertificateRequest(rand.Reader, &template, keyBytes)
-	// csrBytes is in DER format
-	// https://golang.org/pkg/crypto/x509/#CreateCertificateRequest
-
 	// Don't need to write this to disk as I return the CSR as a []byte which is
 	// then used rather than reloading anything from the file. Uncomment
 	// this to save it to help with debugging.
@@ -94,6 +99,36 @@ func GenerateCSR(filename string, domainName string, keyBytes *rsa.PrivateKey) (
 	return csrBytes, nil
 }
 
+// The same as GenerateCSR without writing it out, the CSR is DER
+func CreateCSR(names []string, subject CSRSubject, keyBytes *rsa.PrivateKey) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, errors.New("No names given for the CSR")
+	}
+
+	subj := pkix.Name{
+		Country:            subject.Country,
+		Province:           subject.Province,
+		Locality:           subject.Locality,
+		Organization:       subject.Organization,
+		OrganizationalUnit: subject.OrganizationalUnit,
+	}
+	if len(names[0]) <= maxCommonNameLength {
+		subj.CommonName = names[0]
+	} else {
+		log.Debugf("The name is too long for the CommonName, only using the SANs: %s", names[0])
+	}
+
+	template := x509.CertificateRequest{
+		Subject:            subj,
+		DNSNames:           names,
+		SignatureAlgorithm: x509.SHA256WithRSA,
+	}
+
+	// csrBytes is in DER format
+	// https://golang.org/pkg/crypto/x509/#CreateCertificateRequest
+	return x509.CreateCertificateRequest(rand.Reader, &template, keyBytes)
+}
+
 // https://golang.org/src/crypto/x509/example_test.go
 
 func LoadX509KeyPair(certFile, keyFile string) (*x509.Certificate, *x509.Certificate, *rsa.PrivateKey, *error) {
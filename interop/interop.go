@@ -2,7 +2,10 @@ package interop
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 import log "github.com/sirupsen/logrus"
@@ -41,10 +44,62 @@ func (r RegClient) Unmarshall(s string) (error, regClient) {
 }
 */
 
+// The field names are matched without regard to case when decoding, so
+// the tags don't break anything sending or expecting the old capitalised
+// names
 type RegClientRequest struct {
 	JSONMessage
-	ClientID string
-	IP       string
+	ClientID string `json:"clientID"`
+	// The IPv4 address, kept for servers which don't understand IPs
+	IP string `json:"ip"`
+	// All the addresses, IPv4 and IPv6, to publish for the client
+	IPs []string `json:"ips,omitempty"`
+	// Binds the client to one of the server's tenants
+	EnrollmentToken string `json:"enrollmentToken,omitempty"`
+	// Optional, only used by some of the server's hostname generators
+	Serial   string `json:"serial,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	// A short extra name the client would like on its certificate, the
+	// server decides whether it gets it
+	Alias string `json:"alias,omitempty"`
+}
+
+// Merges IP and IPs, dropping duplicates, so it doesn't matter which
+// the client filled in
+func (r RegClientRequest) Addresses() []string {
+	return mergeAddresses(r.IP, r.IPs)
+}
+
+func mergeAddresses(ip string, ips []string) []string {
+	var addresses []string
+	seen := map[string]bool{}
+	for _, ip := range append([]string{ip}, ips...) {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// The JSON decoder can't tell a missing field from an empty one so the
+// server checks the fields it can't do without here
+func (r RegClientRequest) Validate() error {
+	if err := requireField("clientID", r.ClientID); err != nil {
+		return err
+	}
+	if len(r.Addresses()) == 0 {
+		return errors.New("At least one address is required in ip or ips")
+	}
+	return nil
+}
+
+func requireField(name string, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.New(fmt.Sprintf("The %s field is required", name))
+	}
+	return nil
 }
 
 func (r RegClientResponse) Marshall() string {
@@ -56,21 +111,179 @@ func (r RegClientResponse) Marshall() string {
 	return s
 }
 
+// Reasons an IP address can be refused by the server
+const (
+	IPRejectInvalid    = "invalid"
+	IPRejectDenied     = "denied"
+	IPRejectNotAllowed = "not_allowed"
+)
+
+type IPRejection struct {
+	IP string `json:"ip"`
+	// One of the IPReject constants
+	Reason string `json:"reason"`
+	// Human readable explanation
+	Detail string `json:"detail"`
+}
+
+// An extra name the client was not given
+type NameRefusal struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
 type RegClientResponse struct {
-	Success  bool
-	Message  string
-	Hostname string
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Hostname string `json:"hostname"`
+	// Set when the client asked for a hostname but was given a different one
+	SubstitutionReason string `json:"substitutionReason,omitempty"`
+	// Addresses which were not registered and why
+	RejectedIPs []IPRejection `json:"rejectedIPs,omitempty"`
+	// The names the CSR must contain, exactly these and no others. If
+	// empty, just the hostname.
+	Names []string `json:"names,omitempty"`
+	// Extra names which were not added and why
+	RefusedNames []NameRefusal `json:"refusedNames,omitempty"`
+	Error        *APIError     `json:"error,omitempty"`
 }
 
 type CertificateRequest struct {
 	JSONMessage
-	CSR      []byte
-	ClientID string
+	CSR      []byte `json:"csr"`
+	ClientID string `json:"clientID"`
+}
+
+func (r CertificateRequest) Validate() error {
+	if err := requireField("clientID", r.ClientID); err != nil {
+		return err
+	}
+	if len(r.CSR) == 0 {
+		return errors.New("The csr field is required")
+	}
+	return nil
 }
 
 type CertificateResponse struct {
 	JSONMessage
-	Success      bool
-	Certificates [][]byte
-	Message      string
+	Success      bool     `json:"success"`
+	Certificates [][]byte `json:"certificates"`
+	Message      string   `json:"message"`
+	// The request is waiting on the rate limits, ask again after the
+	// Retry-After header
+	Queued bool `json:"queued,omitempty"`
+	// The certificate is from a staging CA so won't be trusted
+	Staging bool `json:"staging,omitempty"`
+	// The ACME profile the certificate was ordered with, if not the CA's
+	// default
+	Profile string `json:"profile,omitempty"`
+	// When to come back for a new certificate
+	Renewal *RenewalInfo `json:"renewal,omitempty"`
+	Error   *APIError    `json:"error,omitempty"`
+}
+
+// The window comes from the CA's renewal information if it has it.
+// RenewAt is a time picked inside the window for this client, renew then
+// or straight away if it has passed.
+type RenewalInfo struct {
+	WindowStart    time.Time `json:"windowStart"`
+	WindowEnd      time.Time `json:"windowEnd"`
+	RenewAt        time.Time `json:"renewAt"`
+	ExplanationURL string    `json:"explanationURL,omitempty"`
+}
+
+type RenewalInfoRequest struct {
+	JSONMessage
+	ClientID string `json:"clientID"`
+}
+
+func (r RenewalInfoRequest) Validate() error {
+	return requireField("clientID", r.ClientID)
+}
+
+type RenewalInfoResponse struct {
+	JSONMessage
+	Success bool         `json:"success"`
+	Message string       `json:"message"`
+	Renewal *RenewalInfo `json:"renewal,omitempty"`
+	Error   *APIError    `json:"error,omitempty"`
+}
+
+// Sent when the device's addresses change, the DNS records for all its
+// names are replaced with the ones allowed
+type UpdateIPRequest struct {
+	JSONMessage
+	ClientID string   `json:"clientID"`
+	IP       string   `json:"ip,omitempty"`
+	IPs      []string `json:"ips,omitempty"`
+}
+
+func (r UpdateIPRequest) Addresses() []string {
+	return mergeAddresses(r.IP, r.IPs)
+}
+
+func (r UpdateIPRequest) Validate() error {
+	if err := requireField("clientID", r.ClientID); err != nil {
+		return err
+	}
+	if len(r.Addresses()) == 0 {
+		return errors.New("At least one address is required in ip or ips")
+	}
+	return nil
+}
+
+type UpdateIPResponse struct {
+	JSONMessage
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Hostname string `json:"hostname,omitempty"`
+	// The addresses now published
+	IPs         []string      `json:"ips,omitempty"`
+	RejectedIPs []IPRejection `json:"rejectedIPs,omitempty"`
+	Error       *APIError     `json:"error,omitempty"`
+}
+
+// Codes for APIError, the HTTP status goes with them
+const (
+	ErrInvalidJSON            = "invalid_json"             // 400
+	ErrInvalidClientID        = "invalid_client_id"        // 400
+	ErrInvalidCSR             = "invalid_csr"              // 400
+	ErrInvalidHostname        = "invalid_hostname"         // 400
+	ErrNoAllowedIPs           = "no_allowed_ips"           // 400
+	ErrMissingField           = "missing_field"            // 400
+	ErrInvalidEnrollmentToken = "invalid_enrollment_token" // 401
+	ErrUnauthorized           = "unauthorized"             // 401
+	ErrUnknownClient          = "unknown_client"           // 404
+	ErrUnknownTenant          = "unknown_tenant"           // 404
+	ErrNoCertificate          = "no_certificate"           // 404
+	ErrNotFound               = "not_found"                // 404
+	ErrMethodNotAllowed       = "method_not_allowed"       // 405
+	ErrClientExists           = "client_exists"            // 409
+	ErrHostnamesExhausted     = "hostnames_exhausted"      // 409
+	ErrHostnameTaken          = "hostname_taken"           // 409
+	ErrTenantFull             = "tenant_full"              // 409
+	ErrRequestTooLarge        = "request_too_large"        // 413
+	ErrUnsupportedMediaType   = "unsupported_media_type"   // 415
+	ErrRateLimited            = "rate_limited"             // 429
+	ErrIssuanceFailed         = "issuance_failed"          // 500
+	ErrDNSNotManaged          = "dns_not_managed"          // 500
+	ErrInternal               = "internal_error"           // 500
+	ErrCAUnavailable          = "ca_unavailable"           // 503
+)
+
+// Sent along with Success false and Message so older clients which only
+// look at those still work. Retryable says whether sending the same
+// request again later could work, waiting for Retry-After if it is set.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// For errors where there is nothing else to send, it decodes into any of
+// the response types
+type ErrorResponse struct {
+	Success bool      `json:"success"`
+	Message string    `json:"message"`
+	Error   *APIError `json:"error"`
 }
@@ -1,51 +1,310 @@
 package interop
 
+/*
+Picks the addresses a device should publish for itself.
+
+Loopback and link-local addresses are always skipped as is any
+interface which is down or looks like it belongs to a container,
+bridge or VPN. The allow and deny lists are CIDRs, if an allow list
+is given, addresses have to be in it to be used.
+
+If that leaves addresses on more than one interface, the one the
+default route goes out of is used. If it still isn't clear, an error
+listing the candidates is returned so the user can pick one with
+--interface or the allow and deny lists.
+*/
+
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 )
 import log "github.com/sirupsen/logrus"
 
-func GetIP(theInterface string) string {
-	ifaces, _ := net.Interfaces()
-	// handle err
-	var ips []string
+// Prefixes of interface names which are skipped unless asked for by name
+var DefaultSkipInterfaces = []string{
+	"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "cni", "flannel", "cali",
+	"tun", "tap", "wg", "utun", "ppp", "ipsec", "zt", "tailscale",
+}
+
+type IPPolicy struct {
+	// If set, only this interface is used and the skip list is ignored
+	Interface string
+	Allow     []string
+	Deny      []string
+	// If empty, DefaultSkipInterfaces is used
+	SkipInterfaces []string
+}
+
+type Candidate struct {
+	Interface    string
+	IP           net.IP
+	DefaultRoute bool
+}
+
+func (c Candidate) String() string {
+	s := fmt.Sprintf("%s: %s", c.Interface, c.IP)
+	if c.DefaultRoute {
+		s += " (default route)"
+	}
+	return s
+}
+
+// Returned when no single set of addresses could be picked, it lists
+// everything that could have been used
+type CandidateError struct {
+	Message    string
+	Candidates []Candidate
+}
+
+func (e *CandidateError) Error() string {
+	if len(e.Candidates) == 0 {
+		return e.Message
+	}
+	var lines []string
+	for _, c := range e.Candidates {
+		lines = append(lines, "\t"+c.String())
+	}
+	return fmt.Sprintf("%s, candidates are:\n%s\nUse --interface or the allow and deny lists in the config to pick one", e.Message, strings.Join(lines, "\n"))
+}
+
+// Unique local addresses, the IPv6 equivalent of the RFC 1918 ranges
+var ulaBlock = mustParseCIDR("fc00::/7")
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Fatalf("Could not parse CIDR %s, error: %s", cidr, err)
+	}
+	return block
+}
+
+func IsULA(ip net.IP) bool {
+	return ip.To4() == nil && ulaBlock.Contains(ip)
+}
+
+// Parses a list of CIDRs, shared with the server's registration policy
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var blocks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid CIDR %s: %s", cidr, err))
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func inBlocks(ip net.IP, blocks []*net.IPNet) bool {
+	for _, block := range blocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	if theInterface != "" {
-		log.Debugf("The interface given is: %s", theInterface)
+// The local addresses the kernel would use to reach the internet. Dialing
+// UDP doesn't send anything, it just does the route lookup.
+func defaultRouteIPs() map[string]bool {
+	ips := map[string]bool{}
+	for _, target := range []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"} {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			log.Debugf("No route to %s: %s", target, err)
+			continue
+		}
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			log.Debugf("Default route goes out from: %s", addr.IP)
+			ips[addr.IP.String()] = true
+		}
+		conn.Close()
+	}
+	return ips
+}
+
+// Every address which passes the policy, the interface selection is left
+// to SelectIPs
+func FindCandidates(policy IPPolicy) ([]Candidate, error) {
+	allow, err := ParseCIDRs(policy.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := ParseCIDRs(policy.Deny)
+	if err != nil {
+		return nil, err
+	}
+	skip := policy.SkipInterfaces
+	if len(skip) == 0 {
+		skip = DefaultSkipInterfaces
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not list the network interfaces: %s", err))
+	}
+
+	if policy.Interface != "" {
+		log.Debugf("The interface given is: %s", policy.Interface)
 	} else {
 		log.Debug("No interface name provided, searching for any with an internal IP")
 	}
-	for _, i := range ifaces {
-		addrs, _ := i.Addrs()
 
-		if (theInterface == "") || i.Name == theInterface {
-			log.Debugf("Checking IP address on interface: %s", i.Name)
-			for _, addr := range addrs {
-				var ip net.IP
-				switch v := addr.(type) {
-				case *net.IPNet:
-					ip = v.IP
-				case *net.IPAddr:
-					ip = v.IP
-				}
-				if ip.To4() != nil {
-					if ip.String() != "127.0.0.1" {
-						log.Debugf("Found IP: %s", ip.String())
-						ips = append(ips, ip.String())
-					}
+	defaults := defaultRouteIPs()
+	var candidates []Candidate
+
+	for _, i := range ifaces {
+		if policy.Interface != "" {
+			if i.Name != policy.Interface {
+				continue
+			}
+		} else {
+			if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+				log.Debugf("Skipping interface which is down or loopback: %s", i.Name)
+				continue
+			}
+			skipped := false
+			for _, prefix := range skip {
+				if strings.HasPrefix(i.Name, prefix) {
+					skipped = true
+					break
 				}
 			}
+			if skipped {
+				log.Debugf("Skipping container, bridge or VPN interface: %s", i.Name)
+				continue
+			}
+		}
+
+		addrs, _ := i.Addrs()
+		log.Debugf("Checking IP address on interface: %s", i.Name)
+		for _, addr := range addrs {
+			var ip net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ip = v.IP
+			case *net.IPAddr:
+				ip = v.IP
+			}
+			// IsGlobalUnicast is true for private and unique local addresses
+			// but not for loopback, link-local or multicast
+			if ip == nil || !ip.IsGlobalUnicast() {
+				continue
+			}
+			if inBlocks(ip, deny) {
+				log.Debugf("IP is in the deny list: %s", ip)
+				continue
+			}
+			if len(allow) > 0 && !inBlocks(ip, allow) {
+				log.Debugf("IP is not in the allow list: %s", ip)
+				continue
+			}
+			log.Debugf("Found IP: %s", ip)
+			candidates = append(candidates, Candidate{Interface: i.Name, IP: ip, DefaultRoute: defaults[ip.String()]})
+		}
+	}
+	return candidates, nil
+}
+
+// Returns the IPv4 address to use, if there is one, followed by the
+// unique local and global IPv6 addresses from the same interface
+func SelectIPs(policy IPPolicy) ([]string, error) {
+	candidates, err := FindCandidates(policy)
+	if err != nil {
+		return nil, err
+	}
+	return chooseIPs(candidates)
+}
+
+// The choice SelectIPs makes, apart from the interfaces so it can be
+// tested
+func chooseIPs(candidates []Candidate) ([]string, error) {
+	if len(candidates) == 0 {
+		return nil, &CandidateError{Message: "No usable IP addresses found"}
+	}
+
+	var interfaces []string
+	onDefaultRoute := map[string]bool{}
+	for _, c := range candidates {
+		if !contains(interfaces, c.Interface) {
+			interfaces = append(interfaces, c.Interface)
+		}
+		if c.DefaultRoute {
+			onDefaultRoute[c.Interface] = true
 		}
 	}
 
-	if len(ips) == 0 {
-		log.Fatal("No IPs found")
+	chosen := interfaces[0]
+	if len(interfaces) > 1 {
+		if len(onDefaultRoute) != 1 {
+			return nil, &CandidateError{Message: "IP addresses found on more than one interface", Candidates: candidates}
+		}
+		for name := range onDefaultRoute {
+			chosen = name
+		}
+		log.Debugf("Using the interface with the default route: %s", chosen)
+	}
+
+	var v4s, v6s []Candidate
+	for _, c := range candidates {
+		if c.Interface != chosen {
+			continue
+		}
+		if c.IP.To4() != nil {
+			v4s = append(v4s, c)
+		} else {
+			v6s = append(v6s, c)
+		}
+	}
+
+	var ips []string
+	if len(v4s) > 1 {
+		var routed []Candidate
+		for _, c := range v4s {
+			if c.DefaultRoute {
+				routed = append(routed, c)
+			}
+		}
+		if len(routed) != 1 {
+			return nil, &CandidateError{Message: "More than one IPv4 address found", Candidates: v4s}
+		}
+		v4s = routed
+	}
+	if len(v4s) == 1 {
+		log.Debugf("Using IPv4 address: %s", v4s[0].IP)
+		ips = append(ips, v4s[0].IP.String())
 	} else {
-		if len(ips) > 1 {
-			log.Fatal("More than one IP address found, please run with --interface to specify which interface to use")
+		log.Debug("No IPv4 address found, only using IPv6")
+	}
+	for _, c := range v6s {
+		if IsULA(c.IP) {
+			log.Debugf("Using unique local IPv6 address: %s", c.IP)
 		} else {
-			log.Debugf("Just one IP found: %s", ips[0])
+			log.Debugf("Using global IPv6 address: %s", c.IP)
+		}
+		ips = append(ips, c.IP.String())
+	}
+	return ips, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the IPv4 address out of a list returned by SelectIPs, empty if
+// there isn't one
+func FirstIPv4(ips []string) string {
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			return ip
 		}
 	}
-	return ips[0]
+	return ""
 }
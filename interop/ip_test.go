@@ -0,0 +1,79 @@
+package interop
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func candidate(iface string, ip string, defaultRoute bool) Candidate {
+	return Candidate{Interface: iface, IP: net.ParseIP(ip), DefaultRoute: defaultRoute}
+}
+
+func TestChooseIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []Candidate
+		want       []string
+		wantErr    bool
+	}{
+		{"nothing", nil, nil, true},
+		{"one IPv4", []Candidate{candidate("eth0", "192.168.1.10", false)}, []string{"192.168.1.10"}, false},
+		{"IPv4 and IPv6", []Candidate{
+			candidate("eth0", "fd00::10", false),
+			candidate("eth0", "192.168.1.10", false),
+			candidate("eth0", "2001:db8::10", false),
+		}, []string{"192.168.1.10", "fd00::10", "2001:db8::10"}, false},
+		{"IPv6 only", []Candidate{candidate("eth0", "fd00::10", false)}, []string{"fd00::10"}, false},
+		{"two interfaces, one routed", []Candidate{
+			candidate("eth0", "192.168.1.10", false),
+			candidate("wlan0", "10.0.0.5", true),
+		}, []string{"10.0.0.5"}, false},
+		{"two interfaces, neither routed", []Candidate{
+			candidate("eth0", "192.168.1.10", false),
+			candidate("wlan0", "10.0.0.5", false),
+		}, nil, true},
+		{"two IPv4 on one interface, one routed", []Candidate{
+			candidate("eth0", "192.168.1.10", false),
+			candidate("eth0", "192.168.1.11", true),
+		}, []string{"192.168.1.11"}, false},
+		{"two IPv4 on one interface, neither routed", []Candidate{
+			candidate("eth0", "192.168.1.10", false),
+			candidate("eth0", "192.168.1.11", false),
+		}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := chooseIPs(test.candidates)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %t", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		cidrs   []string
+		want    int
+		wantErr bool
+	}{
+		{nil, 0, false},
+		{[]string{"10.0.0.0/8", "fc00::/7"}, 2, false},
+		{[]string{"10.0.0.0/8", "not a cidr"}, 0, true},
+		{[]string{"10.0.0.1"}, 0, true},
+	}
+	for _, test := range tests {
+		blocks, err := ParseCIDRs(test.cidrs)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseCIDRs(%v) error = %v, want error %t", test.cidrs, err, test.wantErr)
+			continue
+		}
+		if len(blocks) != test.want {
+			t.Errorf("ParseCIDRs(%v) gave %d blocks, want %d", test.cidrs, len(blocks), test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+/*
+Admin endpoints, only registered if admin.token is set in the config.
+Requests need the header:
+
+Authorization: Bearer <token>
+
+curl https://otsserver.mydomain.test:9443/v1/admin/quota -H "Authorization: Bearer <token>"
+*/
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+type quota struct {
+	Name     string
+	Used     int
+	Limit    int
+	Headroom int
+	// When the oldest issuance in the window drops out, empty if nothing
+	// has been issued in it
+	NextFree string `json:",omitempty"`
+}
+
+type quotaReport struct {
+	// One for each CA, in the order they are tried
+	Accounts []quota
+	// One for each registered domain the tenants issue under
+	Domains []quota
+	// Certificate requests waiting on the limits
+	Queued int
+}
+
+func newQuota(name string, counter func(string, time.Time) (int, time.Time, error), window time.Duration, limit int) (quota, error) {
+	used, oldest, err := counter(name, time.Now().Add(-window))
+	if err != nil {
+		return quota{}, err
+	}
+	q := quota{Name: name, Used: used, Limit: limit, Headroom: limit - used}
+	if q.Headroom < 0 {
+		q.Headroom = 0
+	}
+	if used > 0 {
+		q.NextFree = oldest.Add(window).UTC().Format(time.RFC3339)
+	}
+	return q, nil
+}
+
+func adminAuthorised(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Cfg.Admin.Token)) == 1
+}
+
+func adminQuota(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("Hit on /admin/quota")
+
+	if !adminAuthorised(r) {
+		log.Printf("Invalid admin token from %s", r.RemoteAddr)
+		writeFailure(w, interop.ErrUnauthorized, "Invalid admin token")
+		return
+	}
+
+	var report quotaReport
+	var err error
+
+	for _, ca := range caOrder {
+		q, err := newQuota(ca.accountURI(), countAccountOrders, accountOrderWindow, Cfg.RateLimits.AccountOrders)
+		if err != nil {
+			writeFailure(w, interop.ErrInternal, fmt.Sprintf("Could not count the orders for %s: %s", ca.Name, err))
+			return
+		}
+		q.Name = ca.Name
+		report.Accounts = append(report.Accounts, q)
+	}
+
+	// Tenants can share a registered domain and so share its budget
+	seen := map[string]bool{}
+	var domains []string
+	for _, t := range tenants {
+		for _, domain := range registeredDomains(append([]string{t.Domain}, t.ExtraNames.ExtraDomains...)) {
+			if !seen[domain] {
+				seen[domain] = true
+				domains = append(domains, domain)
+			}
+		}
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		q, err := newQuota(domain, countIssuances, issuanceWindow, Cfg.RateLimits.WeeklyCertificates)
+		if err != nil {
+			writeFailure(w, interop.ErrInternal, fmt.Sprintf("Could not count the issuances for %s: %s", domain, err))
+			return
+		}
+		report.Domains = append(report.Domains, q)
+	}
+
+	report.Queued, err = queueLength()
+	if err != nil {
+		writeFailure(w, interop.ErrInternal, fmt.Sprintf("Could not read the certificate queue: %s", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
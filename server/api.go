@@ -0,0 +1,163 @@
+package main
+
+/*
+The JSON API lives under /v1/. Every response has success and message,
+failures also have an error object with a code from the interop.Err
+constants, the message and whether it is worth retrying:
+
+{"success":false,"message":"Too many requests from this client",
+ "error":{"code":"rate_limited","message":"Too many requests from this client","retryable":true}}
+
+The HTTP status goes with the code, see apiStatuses. The routes from
+before /v1/ still work as aliases but send Deprecation and Link headers
+pointing at their replacements.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+type apiStatus struct {
+	status    int
+	retryable bool
+}
+
+var apiStatuses = map[string]apiStatus{
+	interop.ErrInvalidJSON:            {http.StatusBadRequest, false},
+	interop.ErrInvalidClientID:        {http.StatusBadRequest, false},
+	interop.ErrInvalidCSR:             {http.StatusBadRequest, false},
+	interop.ErrInvalidHostname:        {http.StatusBadRequest, false},
+	interop.ErrNoAllowedIPs:           {http.StatusBadRequest, false},
+	interop.ErrMissingField:           {http.StatusBadRequest, false},
+	interop.ErrInvalidEnrollmentToken: {http.StatusUnauthorized, false},
+	interop.ErrUnauthorized:           {http.StatusUnauthorized, false},
+	interop.ErrUnknownClient:          {http.StatusNotFound, false},
+	interop.ErrUnknownTenant:          {http.StatusNotFound, false},
+	interop.ErrNoCertificate:          {http.StatusNotFound, false},
+	interop.ErrNotFound:               {http.StatusNotFound, false},
+	interop.ErrMethodNotAllowed:       {http.StatusMethodNotAllowed, false},
+	interop.ErrClientExists:           {http.StatusConflict, false},
+	interop.ErrHostnamesExhausted:     {http.StatusConflict, false},
+	interop.ErrHostnameTaken:          {http.StatusConflict, false},
+	interop.ErrTenantFull:             {http.StatusConflict, false},
+	interop.ErrRequestTooLarge:        {http.StatusRequestEntityTooLarge, false},
+	interop.ErrUnsupportedMediaType:   {http.StatusUnsupportedMediaType, false},
+	interop.ErrRateLimited:            {http.StatusTooManyRequests, true},
+	interop.ErrIssuanceFailed:         {http.StatusInternalServerError, false},
+	interop.ErrDNSNotManaged:          {http.StatusInternalServerError, false},
+	interop.ErrInternal:               {http.StatusInternalServerError, true},
+	interop.ErrCAUnavailable:          {http.StatusServiceUnavailable, true},
+}
+
+func newAPIError(code string, msg string) *interop.APIError {
+	return &interop.APIError{Code: code, Message: msg, Retryable: apiStatuses[code].retryable}
+}
+
+func apiErrorStatus(code string) int {
+	if s, ok := apiStatuses[code]; ok {
+		return s.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Written with w.Write, the body is never used as a format string
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	js, err := json.Marshal(response)
+	if err != nil {
+		log.Fatalf(fmt.Sprintf("Error marshalling the JSON response, error: %s", err.Error()))
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// For responses which carry extra detail along with the error, the
+// response must already have Error set
+func writeFailureResponse(w http.ResponseWriter, code string, response interface{}) {
+	status := apiErrorStatus(code)
+	log.Debugf("Returning a %d to the user: %s", status, code)
+	writeJSON(w, status, response)
+}
+
+func writeFailure(w http.ResponseWriter, code string, msg string) {
+	writeFailureResponse(w, code, interop.ErrorResponse{Success: false, Message: msg, Error: newAPIError(code, msg)})
+}
+
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := setRetryAfter(w, retryAfter)
+	log.Debugf("Rate limited, retry after %d seconds: %s", seconds, msg)
+	writeFailure(w, interop.ErrRateLimited, msg)
+}
+
+type apiRequest interface {
+	Validate() error
+}
+
+// Reads a single JSON object into request, refusing anything that isn't
+// JSON, is too big, has fields we don't know about or is missing ones we
+// need. Returns false if the failure has already been written.
+func decodeRequest(w http.ResponseWriter, r *http.Request, request apiRequest) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		log.Printf("Invalid request, aborting")
+		writeFailure(w, interop.ErrUnsupportedMediaType, "The request must be sent with the Content-Type application/json")
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, Cfg.WebServer.MaxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		log.Printf("Invalid request, aborting")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeFailure(w, interop.ErrRequestTooLarge, fmt.Sprintf("The request is larger than the limit of %d bytes", tooLarge.Limit))
+			return false
+		}
+		log.Debugf("There was an error decoding the JSON: %s", err)
+		writeFailure(w, interop.ErrInvalidJSON, fmt.Sprintf("Error decoding the JSON\nError message: %s", err))
+		return false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		log.Printf("Invalid request, aborting")
+		writeFailure(w, interop.ErrInvalidJSON, "The request must be a single JSON object")
+		return false
+	}
+
+	if err := request.Validate(); err != nil {
+		log.Printf("Invalid request, aborting")
+		log.Debugf("%s", err)
+		writeFailure(w, interop.ErrMissingField, err.Error())
+		return false
+	}
+	return true
+}
+
+// Wraps a handler for one of the old routes
+func deprecatedRoute(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("Call to the deprecated route %s, use %s", r.URL.Path, successor)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		handler(w, r)
+	}
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeFailure(w, interop.ErrNotFound, fmt.Sprintf("No such endpoint: %s", r.URL.Path))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeFailure(w, interop.ErrMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/digininja/ots-cert-demo/interop"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	Cfg.WebServer.MaxBodyBytes = 128
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"valid", "application/json", `{"clientID":"abc","csr":"AQID"}`, http.StatusOK, ""},
+		{"charset", "application/json; charset=utf-8", `{"clientID":"abc","csr":"AQID"}`, http.StatusOK, ""},
+		{"no content type", "", `{"clientID":"abc","csr":"AQID"}`, http.StatusUnsupportedMediaType, interop.ErrUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", `clientID=abc`, http.StatusUnsupportedMediaType, interop.ErrUnsupportedMediaType},
+		{"too large", "application/json", `{"clientID":"` + strings.Repeat("a", 200) + `","csr":"AQID"}`, http.StatusRequestEntityTooLarge, interop.ErrRequestTooLarge},
+		{"unknown field", "application/json", `{"clientID":"abc","csr":"AQID","admin":true}`, http.StatusBadRequest, interop.ErrInvalidJSON},
+		{"trailing data", "application/json", `{"clientID":"abc","csr":"AQID"}{}`, http.StatusBadRequest, interop.ErrInvalidJSON},
+		{"not JSON", "application/json", `clientID`, http.StatusBadRequest, interop.ErrInvalidJSON},
+		{"missing field", "application/json", `{"clientID":"abc"}`, http.StatusBadRequest, interop.ErrMissingField},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/v1/certificate", strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+
+		var request interop.CertificateRequest
+		ok := decodeRequest(w, r, &request)
+		if ok != (test.status == http.StatusOK) {
+			t.Errorf("%s: decodeRequest = %t", test.name, ok)
+			continue
+		}
+		if ok {
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.status)
+		}
+		var response interop.ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if response.Error == nil || response.Error.Code != test.code {
+			t.Errorf("%s: error %+v, want code %s", test.name, response.Error, test.code)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+/*
+ACME Renewal Information, see RFC 9773 (draft-ietf-acme-ari).
+
+Every certificate issued is recorded in the certificates table with a
+renewal window. If the CA has a renewalInfo endpoint, the window comes
+from there and is checked again as often as the CA's Retry-After says,
+so if the CA needs to revoke a batch of certificates it can pull the
+window forward and clients will pick it up. Otherwise the window is the
+usual last third of the certificate's life.
+
+Clients are given a time picked at random inside the window, which
+spreads the renewals of a fleet out instead of them all coming back at
+once. The time is only picked again when the window moves.
+*/
+
+import (
+	"context"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// How often to check when the CA doesn't send a Retry-After, and the
+// limits put on what it does send. Short lived certificates are checked
+// more often, see ariInterval.
+const (
+	defaultARIInterval = 6 * time.Hour
+	minARIInterval     = time.Hour
+	maxARIInterval     = 24 * time.Hour
+)
+
+var errNoARI = errors.New("The CA does not support ARI")
+
+type renewalWindow struct {
+	start          time.Time
+	end            time.Time
+	explanationURL string
+}
+
+type ariResponse struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+}
+
+// The ID is the authority key identifier and the serial number, each
+// base64url encoded. The serial is the DER integer contents so has a
+// leading zero if the top bit is set.
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("The certificate has no authority key identifier")
+	}
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// Renew in the last third of the certificate's life. Short lived
+// certificates are renewed from half way through so there is time to try
+// again if the CA is down.
+func defaultRenewalWindow(cert *x509.Certificate) renewalWindow {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime < shortLivedLifetime {
+		return renewalWindow{
+			start: cert.NotBefore.Add(lifetime / 2),
+			end:   cert.NotBefore.Add(lifetime * 2 / 3),
+		}
+	}
+	return renewalWindow{
+		start: cert.NotBefore.Add(lifetime * 2 / 3),
+		end:   cert.NotBefore.Add(lifetime * 5 / 6),
+	}
+}
+
+func pickRenewalTime(window renewalWindow) time.Time {
+	span := window.end.Sub(window.start)
+	if span <= 0 {
+		return window.start
+	}
+	return window.start.Add(time.Duration(mathrand.Int63n(int64(span))))
+}
+
+// Returns the suggested window and how long until it should be asked for
+// again
+func (ca *certificateAuthority) fetchRenewalInfo(ctx context.Context, certID string) (renewalWindow, time.Duration, error) {
+	var window renewalWindow
+	directory, err := ca.directory(ctx)
+	if err != nil {
+		return window, 0, err
+	}
+	base := directory.RenewalInfo
+	if base == "" {
+		return window, 0, errNoARI
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(base, "/")+"/"+certID, nil)
+	if err != nil {
+		return window, 0, err
+	}
+	resp, err := ca.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return window, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return window, 0, errors.New(fmt.Sprintf("Fetching the renewal information returned: %s", resp.Status))
+	}
+
+	var info ariResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return window, 0, err
+	}
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return window, 0, errors.New("The suggested window is not valid")
+	}
+
+	window = renewalWindow{start: info.SuggestedWindow.Start, end: info.SuggestedWindow.End, explanationURL: info.ExplanationURL}
+	return window, ariRetryAfter(resp.Header.Get("Retry-After")), nil
+}
+
+func ariRetryAfter(header string) time.Duration {
+	interval := defaultARIInterval
+	if seconds, err := strconv.Atoi(header); err == nil {
+		interval = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(header); err == nil {
+		interval = time.Until(when)
+	}
+	if interval < minARIInterval {
+		return minARIInterval
+	}
+	if interval > maxARIInterval {
+		return maxARIInterval
+	}
+	return interval
+}
+
+// A six day certificate can't wait a day between checks, never go more
+// than a twelfth of the lifetime
+func ariInterval(retryAfter time.Duration, notBefore time.Time, notAfter time.Time) time.Duration {
+	if limit := notAfter.Sub(notBefore) / 12; retryAfter > limit && limit >= minARIInterval {
+		return limit
+	}
+	return retryAfter
+}
+
+// Stores the certificate along with its renewal window, anything issued
+// to the client before is marked as replaced. Returns what to tell the
+// client about renewing.
+func recordCertificate(uuid string, fqdn string, ca *certificateAuthority, profile string, certificates [][]byte) *interop.RenewalInfo {
+	if len(certificates) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(certificates[0])
+	if err != nil {
+		log.Printf("Could not parse the certificate for %s, error: %s", fqdn, err)
+		return nil
+	}
+
+	window := defaultRenewalWindow(cert)
+	nextCheck := time.Time{}
+	certID, err := ariCertID(cert)
+	if err != nil {
+		log.Debugf("Can't use ARI for %s: %s", fqdn, err)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ariWindow, retryAfter, err := ca.fetchRenewalInfo(ctx, certID)
+		switch {
+		case err == nil:
+			window = ariWindow
+			nextCheck = time.Now().Add(ariInterval(retryAfter, cert.NotBefore, cert.NotAfter))
+		case err == errNoARI:
+			certID = ""
+		default:
+			// Try again on the next run of the scheduler
+			log.Printf("Could not get the renewal information for %s, error: %s", fqdn, err)
+			nextCheck = time.Now()
+		}
+	}
+	renewAt := pickRenewalTime(window)
+
+	if _, err := database.Exec("UPDATE certificates SET replaced = 1 WHERE uuid = ? AND fqdn = ?", uuid, fqdn); err != nil {
+		log.Printf("Could not mark the old certificates for %s as replaced, error: %s", fqdn, err)
+	}
+	_, err = database.Exec(`INSERT INTO certificates (uuid, fqdn, ca, profile, serial, ari_id, not_before, not_after,
+		window_start, window_end, renew_at, explanation_url, next_check, replaced)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,0)`,
+		uuid, fqdn, ca.Name, profile, cert.SerialNumber.Text(16), certID, cert.NotBefore.Unix(), cert.NotAfter.Unix(),
+		window.start.Unix(), window.end.Unix(), renewAt.Unix(), window.explanationURL, nextCheck.Unix())
+	if err != nil {
+		log.Printf("Could not record the certificate for %s, error: %s", fqdn, err)
+	}
+
+	log.Debugf("The certificate for %s should be renewed between %s and %s, picked %s", fqdn, window.start, window.end, renewAt)
+	return &interop.RenewalInfo{WindowStart: window.start, WindowEnd: window.end, RenewAt: renewAt, ExplanationURL: window.explanationURL}
+}
+
+// The renewal information for the client's current certificate, nil if
+// it doesn't have one
+func getRenewalInfo(uuid string) (*interop.RenewalInfo, error) {
+	var start, end, renewAt int64
+	var explanationURL sql.NullString
+	row := database.QueryRow(`SELECT window_start, window_end, renew_at, explanation_url FROM certificates
+		WHERE uuid = ? AND replaced = 0 ORDER BY not_before DESC LIMIT 1`, uuid)
+	err := row.Scan(&start, &end, &renewAt, &explanationURL)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &interop.RenewalInfo{
+		WindowStart:    time.Unix(start, 0),
+		WindowEnd:      time.Unix(end, 0),
+		RenewAt:        time.Unix(renewAt, 0),
+		ExplanationURL: explanationURL.String,
+	}, nil
+}
+
+type ariCheck struct {
+	id        int64
+	fqdn      string
+	ca        string
+	certID    string
+	start     int64
+	end       int64
+	notBefore int64
+	notAfter  int64
+}
+
+// Asks the CAs for new windows for any current certificates that are due
+// a check
+func refreshRenewalInfo() {
+	now := time.Now()
+	rows, err := database.Query(`SELECT id, fqdn, ca, ari_id, window_start, window_end, not_before, not_after FROM certificates
+		WHERE replaced = 0 AND ari_id != '' AND not_after > ? AND next_check <= ?`, now.Unix(), now.Unix())
+	if err != nil {
+		log.Printf("Could not read the certificates due a renewal check, error: %s", err)
+		return
+	}
+	var due []ariCheck
+	for rows.Next() {
+		var c ariCheck
+		if err := rows.Scan(&c.id, &c.fqdn, &c.ca, &c.certID, &c.start, &c.end, &c.notBefore, &c.notAfter); err != nil {
+			log.Printf("Could not read the certificates due a renewal check, error: %s", err)
+			rows.Close()
+			return
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+
+	for _, c := range due {
+		ca, ok := cas[c.ca]
+		if !ok {
+			log.Debugf("The CA %s is no longer configured, not checking %s", c.ca, c.fqdn)
+			database.Exec("UPDATE certificates SET next_check = ? WHERE id = ?", now.Add(maxARIInterval).Unix(), c.id)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		window, retryAfter, err := ca.fetchRenewalInfo(ctx, c.certID)
+		cancel()
+		if err != nil {
+			log.Printf("Could not get the renewal information for %s, error: %s", c.fqdn, err)
+			retry := ariInterval(defaultARIInterval, time.Unix(c.notBefore, 0), time.Unix(c.notAfter, 0))
+			database.Exec("UPDATE certificates SET next_check = ? WHERE id = ?", now.Add(retry).Unix(), c.id)
+			continue
+		}
+		retryAfter = ariInterval(retryAfter, time.Unix(c.notBefore, 0), time.Unix(c.notAfter, 0))
+
+		if window.start.Unix() == c.start && window.end.Unix() == c.end {
+			database.Exec("UPDATE certificates SET next_check = ? WHERE id = ?", now.Add(retryAfter).Unix(), c.id)
+			continue
+		}
+
+		renewAt := pickRenewalTime(window)
+		log.Printf("The renewal window for %s has moved to %s - %s", c.fqdn, window.start, window.end)
+		if window.explanationURL != "" {
+			log.Printf("The CA's explanation is at: %s", window.explanationURL)
+		}
+		_, err = database.Exec(`UPDATE certificates SET window_start = ?, window_end = ?, renew_at = ?, explanation_url = ?, next_check = ?
+			WHERE id = ?`, window.start.Unix(), window.end.Unix(), renewAt.Unix(), window.explanationURL, now.Add(retryAfter).Unix(), c.id)
+		if err != nil {
+			log.Printf("Could not update the renewal window for %s, error: %s", c.fqdn, err)
+		}
+	}
+}
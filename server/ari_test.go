@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestARICertID(t *testing.T) {
+	// The AKI and the first serial are the example in RFC 9773
+	aki := []byte{0x69, 0x88, 0x5b, 0x6b, 0x87, 0x46, 0x40, 0x41, 0xe1, 0xb3, 0x7b, 0x84, 0x7b, 0xa0, 0xae, 0x2c, 0xde, 0x01, 0xc8, 0xd4}
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    string
+		wantErr bool
+	}{
+		{"top bit set", &x509.Certificate{AuthorityKeyId: aki, SerialNumber: new(big.Int).SetBytes([]byte{0x87, 0x65, 0x43, 0x21})}, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", false},
+		{"top bit clear", &x509.Certificate{AuthorityKeyId: aki, SerialNumber: big.NewInt(0x0102)}, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AQI", false},
+		{"no AKI", &x509.Certificate{SerialNumber: big.NewInt(1)}, "", true},
+	}
+	for _, test := range tests {
+		got, err := ariCertID(test.cert)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: ariCertID = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestARIRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", defaultARIInterval},
+		{"junk", defaultARIInterval},
+		{strconv.Itoa(3 * 3600), 3 * time.Hour},
+		{"60", minARIInterval},
+		{strconv.Itoa(7 * 24 * 3600), maxARIInterval},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), minARIInterval},
+	}
+	for _, test := range tests {
+		if got := ariRetryAfter(test.header); got != test.want {
+			t.Errorf("ariRetryAfter(%q) = %s, want %s", test.header, got, test.want)
+		}
+	}
+
+	// An HTTP date a few hours off, give or take the second it is rounded to
+	header := time.Now().Add(5 * time.Hour).UTC().Format(http.TimeFormat)
+	if got := ariRetryAfter(header); got < 5*time.Hour-2*time.Second || got > 5*time.Hour {
+		t.Errorf("ariRetryAfter(%q) = %s, want about 5h", header, got)
+	}
+}
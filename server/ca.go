@@ -0,0 +1,333 @@
+package main
+
+/*
+Certificates can be ordered from any ACME CA, not just Let's Encrypt.
+Each CA is set up from a profile in the config, see config.CAProfile,
+and [acme] ca picks which one is used. If [acme] failover is set, the
+CAs in it are tried in that order until one issues the certificate.
+
+ZeroSSL and some private CAs need External Account Binding, the key ID
+and HMAC key come from the CA's dashboard. Private CAs such as step-ca
+usually have a directory served with a certificate from their own
+root, give the root in trustedRoots so it can be reached.
+
+In staging mode the CAs' staging directories and separate account keys
+are used so development doesn't touch the real accounts or limits.
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/server/config"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// Directories for the public CAs which can be used by name alone
+var knownDirectories = map[string]string{
+	"letsencrypt": letsEncryptDirectory,
+	"zerossl":     "https://acme.zerossl.com/v2/DV90",
+	"buypass":     "https://api.buypass.com/acme/directory",
+}
+
+// ZeroSSL doesn't have a staging environment
+var knownStagingDirectories = map[string]string{
+	"letsencrypt": letsEncryptStagingDirectory,
+	"buypass":     "https://api.test4.buypass.no/acme/directory",
+}
+
+var errNoStagingDirectory = errors.New("No staging directory")
+
+// Staging accounts are kept apart from the real ones,
+// acme-account.key becomes acme-account.staging.key
+func stagingKeyFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".staging" + ext
+}
+
+type certificateAuthority struct {
+	config.CAProfile
+	client *acme.Client
+	// The account URI, issuances are tracked against it. Empty until the
+	// account has been registered.
+	mutex   sync.Mutex
+	account string
+	// The parts of the directory the acme package doesn't read, fetched
+	// the first time they are needed. The mutex only guards the field,
+	// it isn't held while fetching.
+	extrasMutex sync.Mutex
+	extras      *directoryExtras
+}
+
+// Newer additions to the directory, renewalInfo for ARI, the certificate
+// profiles the CA offers and the names it looks for in CAA records
+type directoryExtras struct {
+	RenewalInfo string `json:"renewalInfo"`
+	Meta        struct {
+		Profiles      map[string]string `json:"profiles"`
+		CAAIdentities []string          `json:"caaIdentities"`
+	} `json:"meta"`
+}
+
+var cas = map[string]*certificateAuthority{}
+
+// The CAs to try, in priority order
+var caOrder []*certificateAuthority
+
+// The EAB HMAC key is normally base64url without padding but some CAs
+// hand it out padded
+func decodeHMACKey(key string) ([]byte, error) {
+	if decoded, err := base64.RawURLEncoding.DecodeString(key); err == nil {
+		return decoded, nil
+	}
+	return base64.URLEncoding.DecodeString(key)
+}
+
+func trustedRootsClient(filename string) (*http.Client, error) {
+	rootsPEM, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in %s", filename))
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+func newCertificateAuthority(profile config.CAProfile) (*certificateAuthority, error) {
+	if Cfg.ACME.Staging {
+		profile.DirectoryURL = profile.StagingDirectoryURL
+		if profile.DirectoryURL == "" {
+			profile.DirectoryURL = knownStagingDirectories[strings.ToLower(profile.Name)]
+		}
+		if profile.DirectoryURL == "" {
+			return nil, errNoStagingDirectory
+		}
+		profile.AccountKeyFilename = stagingKeyFilename(profile.AccountKeyFilename)
+	}
+	if profile.DirectoryURL == "" {
+		directory, ok := knownDirectories[strings.ToLower(profile.Name)]
+		if !ok {
+			return nil, errors.New("No directory URL given")
+		}
+		profile.DirectoryURL = directory
+	}
+	log.Debugf("The directory for %s is %s", profile.Name, profile.DirectoryURL)
+
+	accountKey, err := loadOrCreateAccountKey(profile.AccountKeyFilename)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't load the account key, error: %s", err))
+	}
+
+	ca := &certificateAuthority{CAProfile: profile}
+	ca.client = &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: profile.DirectoryURL,
+	}
+	if profile.TrustedRoots != "" {
+		log.Debugf("Trusting the roots in %s for %s", profile.TrustedRoots, profile.Name)
+		ca.client.HTTPClient, err = trustedRootsClient(profile.TrustedRoots)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't load the trusted roots, error: %s", err))
+		}
+	}
+	return ca, nil
+}
+
+func (ca *certificateAuthority) register(ctx context.Context) error {
+	account := &acme.Account{}
+	if ca.Email != "" {
+		account.Contact = []string{"mailto:" + ca.Email}
+	}
+	if ca.EABKeyID != "" {
+		key, err := decodeHMACKey(ca.EABHMACKey)
+		if err != nil {
+			return errors.New(fmt.Sprintf("The EAB HMAC key is not valid base64url, error: %s", err))
+		}
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: ca.EABKeyID, Key: key}
+	}
+
+	log.Debugf("Registering the account with %s", ca.Name)
+	registered, err := ca.client.Register(ctx, account, func(tos string) bool {
+		log.Debugf("Agreeing to ToS: %s", tos)
+		return true
+	})
+	if err == acme.ErrAccountAlreadyExists {
+		log.Debug("The account is already registered, fetching it")
+		registered, err = ca.client.GetReg(ctx, "")
+	}
+	if err != nil {
+		return err
+	}
+	ca.mutex.Lock()
+	ca.account = registered.URI
+	ca.mutex.Unlock()
+	log.Debugf("The ACME account with %s is: %s", ca.Name, registered.URI)
+	return nil
+}
+
+func (ca *certificateAuthority) httpClient() *http.Client {
+	if ca.client.HTTPClient != nil {
+		return ca.client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Two callers can both fetch it the first time, the second result
+// replaces the first which does no harm
+func (ca *certificateAuthority) directory(ctx context.Context) (*directoryExtras, error) {
+	ca.extrasMutex.Lock()
+	extras := ca.extras
+	ca.extrasMutex.Unlock()
+	if extras != nil {
+		return extras, nil
+	}
+
+	req, err := http.NewRequest("GET", ca.DirectoryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ca.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Fetching the directory returned: %s", resp.Status))
+	}
+
+	extras = &directoryExtras{}
+	if err := json.NewDecoder(resp.Body).Decode(extras); err != nil {
+		return nil, err
+	}
+	if extras.RenewalInfo == "" {
+		log.Debugf("%s does not support ARI", ca.Name)
+	}
+	ca.extrasMutex.Lock()
+	ca.extras = extras
+	ca.extrasMutex.Unlock()
+	return extras, nil
+}
+
+func (ca *certificateAuthority) accountURI() string {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.account
+}
+
+func initACME() {
+	for _, profile := range Cfg.ACME.CAs {
+		if profile.Name == "" {
+			log.Fatal("Every CA needs a name")
+		}
+		if _, exists := cas[profile.Name]; exists {
+			log.Fatalf("The CA name is used more than once: %s", profile.Name)
+		}
+		ca, err := newCertificateAuthority(profile)
+		if err == errNoStagingDirectory {
+			log.Printf("The CA %s has no staging environment, it won't be used", profile.Name)
+			continue
+		}
+		if err != nil {
+			log.Fatalf("Problem with the CA %s: %s", profile.Name, err)
+		}
+		cas[profile.Name] = ca
+	}
+
+	order := Cfg.ACME.Failover
+	if len(order) == 0 {
+		order = []string{Cfg.ACME.CA}
+	}
+	for _, name := range order {
+		ca, ok := cas[name]
+		if !ok {
+			if Cfg.ACME.Staging {
+				continue
+			}
+			log.Fatalf("The CA to use is not configured: %s", name)
+		}
+		caOrder = append(caOrder, ca)
+	}
+	if len(caOrder) == 0 {
+		log.Fatal("None of the CAs to use have a staging environment")
+	}
+	if Cfg.ACME.Staging {
+		log.Print("Using the staging environment, certificates will not be trusted")
+	}
+
+	// A CA that is down now gets another go when it is first used, as
+	// long as one of them is up the server can start
+	registered := 0
+	for _, ca := range caOrder {
+		if err := ca.register(context.Background()); err != nil {
+			log.Printf("Can't register an account with %s, error: %s", ca.Name, err)
+			continue
+		}
+		registered++
+	}
+	if registered == 0 {
+		log.Fatal("Could not register an account with any of the CAs")
+	}
+}
+
+// The name at the top of the chain, what the preferred chain is matched
+// against
+func chainTop(certs [][]byte) (string, string) {
+	if len(certs) == 0 {
+		return "", ""
+	}
+	top, err := x509.ParseCertificate(certs[len(certs)-1])
+	if err != nil {
+		return "", ""
+	}
+	return top.Subject.CommonName, top.Issuer.CommonName
+}
+
+func chainMatches(certs [][]byte, preferred string) bool {
+	subject, issuer := chainTop(certs)
+	return subject == preferred || issuer == preferred
+}
+
+// If the CA offers other chains and the default doesn't end at the
+// preferred one, looks through the alternates for one that does. The
+// default is kept if none match.
+func (ca *certificateAuthority) preferredChain(ctx context.Context, certs [][]byte, certURL string) [][]byte {
+	if ca.PreferredChain == "" || chainMatches(certs, ca.PreferredChain) {
+		return certs
+	}
+	alternates, err := ca.client.ListCertAlternates(ctx, certURL)
+	if err != nil {
+		log.Debugf("Could not list the alternate chains, error: %s", err)
+		return certs
+	}
+	for _, url := range alternates {
+		alternate, err := ca.client.FetchCert(ctx, url, true)
+		if err != nil {
+			log.Debugf("Could not fetch the alternate chain %s, error: %s", url, err)
+			continue
+		}
+		if chainMatches(alternate, ca.PreferredChain) {
+			log.Debugf("Using the alternate chain ending at %s", ca.PreferredChain)
+			return alternate
+		}
+	}
+	log.Printf("No chain ending at %s was offered, using the default", ca.PreferredChain)
+	return certs
+}
@@ -0,0 +1,447 @@
+package main
+
+/*
+CAA pre-flight checks, RFC 8659 and RFC 8657.
+
+Before ordering, the CAA records for each name are looked up the way the
+CA will do it, climbing from the name towards the root until a name with
+CAA records is found. If they don't allow the CA, or they pin a
+different account or validation method, the order would fail with a
+hard to read ACME error so it is stopped here with a clear one and the
+next CA is tried.
+
+The standard library can't look up CAA records so the query is sent to
+[acme] caaResolver directly. A failed lookup doesn't stop the order, the
+CA has the final say.
+
+Running the server with -writecaa publishes issue records for every CA
+in use, locked to the server's accounts and to dns-01.
+*/
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const typeCAA = dnsmessage.Type(257)
+
+// Tags which are understood, a critical record with any other tag stops
+// all issuance
+var knownCAATags = map[string]bool{
+	"issue":        true,
+	"issuewild":    true,
+	"iodef":        true,
+	"contactemail": true,
+	"contactphone": true,
+	"issuemail":    true,
+	"issuevmc":     true,
+}
+
+type caaRecord struct {
+	flags uint8
+	tag   string
+	value string
+}
+
+// Returned when the CAA records don't allow the CA, another CA might be
+// allowed
+type caaError struct {
+	err error
+}
+
+func (e caaError) Error() string {
+	return fmt.Sprintf("CAA check failed, %s", e.err)
+}
+
+func parseCAA(data []byte) (caaRecord, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return caaRecord{}, errors.New("CAA record too short")
+	}
+	tagLength := int(data[1])
+	return caaRecord{
+		flags: data[0],
+		tag:   strings.ToLower(string(data[2 : 2+tagLength])),
+		value: string(data[2+tagLength:]),
+	}, nil
+}
+
+func caaQuery(name string) ([]byte, error) {
+	fqdn, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(mathrand.Intn(65536)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: fqdn, Type: typeCAA, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// Sends the query over UDP, switching to TCP if the answer is truncated.
+// Answers whose ID or question don't match the query are thrown away, over
+// UDP they could be stray or spoofed packets so it keeps listening until
+// the deadline.
+func caaExchange(ctx context.Context, query []byte) (dnsmessage.Message, error) {
+	var sent dnsmessage.Message
+	if err := sent.Unpack(query); err != nil {
+		return sent, err
+	}
+
+	var response dnsmessage.Message
+	for _, network := range []string{"udp", "tcp"} {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, network, Cfg.ACME.CAAResolver)
+		if err != nil {
+			return response, err
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if network == "udp" {
+			response, err = caaExchangeUDP(conn, query, sent)
+		} else {
+			response, err = caaExchangeTCP(conn, query, sent)
+		}
+		conn.Close()
+		if err != nil {
+			return response, err
+		}
+		if !response.Truncated {
+			break
+		}
+		log.Debug("The CAA answer was truncated, asking again over TCP")
+	}
+	return response, nil
+}
+
+func caaExchangeUDP(conn net.Conn, query []byte, sent dnsmessage.Message) (dnsmessage.Message, error) {
+	var response dnsmessage.Message
+	if _, err := conn.Write(query); err != nil {
+		return response, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return response, err
+		}
+		if err := response.Unpack(buf[:n]); err != nil {
+			log.Debugf("Discarding a DNS answer which can't be read, error: %s", err)
+			continue
+		}
+		if answersQuery(sent, response) {
+			return response, nil
+		}
+		log.Debug("Discarding a DNS answer which is not for the query")
+	}
+}
+
+func caaExchangeTCP(conn net.Conn, query []byte, sent dnsmessage.Message) (dnsmessage.Message, error) {
+	var response dnsmessage.Message
+	// Over TCP each message has a two byte length in front
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return response, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return response, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return response, err
+	}
+	if err := response.Unpack(buf); err != nil {
+		return response, err
+	}
+	if !answersQuery(sent, response) {
+		return response, errors.New("The DNS answer is not for the query")
+	}
+	return response, nil
+}
+
+// The ID and the question have to be the ones sent, names are compared
+// without case as resolvers may change it
+func answersQuery(sent dnsmessage.Message, response dnsmessage.Message) bool {
+	if !response.Header.Response || response.Header.ID != sent.Header.ID {
+		return false
+	}
+	if len(response.Questions) != 1 || len(sent.Questions) != 1 {
+		return false
+	}
+	asked, answered := sent.Questions[0], response.Questions[0]
+	return strings.EqualFold(asked.Name.String(), answered.Name.String()) &&
+		asked.Type == answered.Type && asked.Class == answered.Class
+}
+
+// The CAA records at exactly this name, following CNAMEs as the
+// resolver does. A name that doesn't exist has none.
+func lookupCAA(ctx context.Context, name string) ([]caaRecord, error) {
+	query, err := caaQuery(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := caaExchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("The CAA lookup for %s returned %s", name, response.RCode))
+	}
+
+	var records []caaRecord
+	for _, answer := range response.Answers {
+		if answer.Header.Type != typeCAA {
+			continue
+		}
+		unknown, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		record, err := parseCAA(unknown.Data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// The first non-empty set of records from the name up towards the root,
+// RFC 8659 section 3
+func relevantCAA(ctx context.Context, name string, cache map[string][]caaRecord) ([]caaRecord, string, error) {
+	for current := name; current != ""; {
+		records, done := cache[current]
+		if !done {
+			var err error
+			records, err = lookupCAA(ctx, current)
+			if err != nil {
+				return nil, "", err
+			}
+			cache[current] = records
+		}
+		if len(records) > 0 {
+			return records, current, nil
+		}
+		dot := strings.Index(current, ".")
+		if dot < 0 {
+			break
+		}
+		current = current[dot+1:]
+	}
+	return nil, "", nil
+}
+
+// Splits "ca.example; accounturi=https://...; validationmethods=dns-01"
+// into the issuer and its parameters
+func parseIssueValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	issuer := strings.ToLower(strings.TrimSpace(parts[0]))
+	params := map[string]string{}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	return issuer, params
+}
+
+// Whether the record lets this CA issue with our account through dns-01
+func issueAllows(record caaRecord, identities []string, account string) bool {
+	issuer, params := parseIssueValue(record.value)
+	if issuer == "" {
+		return false
+	}
+	matched := false
+	for _, identity := range identities {
+		if strings.EqualFold(issuer, identity) {
+			matched = true
+		}
+	}
+	if !matched {
+		return false
+	}
+	if uri, ok := params["accounturi"]; ok && uri != account {
+		return false
+	}
+	if methods, ok := params["validationmethods"]; ok {
+		allowed := false
+		for _, method := range strings.Split(methods, ",") {
+			if strings.TrimSpace(method) == "dns-01" {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+func (ca *certificateAuthority) caaIdentities(ctx context.Context) []string {
+	if len(ca.CAAIdentities) > 0 {
+		return ca.CAAIdentities
+	}
+	directory, err := ca.directory(ctx)
+	if err != nil {
+		log.Debugf("Can't read the CAA identities for %s, error: %s", ca.Name, err)
+		return nil
+	}
+	return directory.Meta.CAAIdentities
+}
+
+// Checks every name would be allowed by its CAA records
+func (ca *certificateAuthority) checkCAA(ctx context.Context, names []string) error {
+	if !Cfg.ACME.CheckCAA {
+		return nil
+	}
+	identities := ca.caaIdentities(ctx)
+	if len(identities) == 0 {
+		log.Debugf("No CAA identities known for %s, skipping the CAA check", ca.Name)
+		return nil
+	}
+
+	cache := map[string][]caaRecord{}
+	for _, name := range names {
+		wildcard := strings.HasPrefix(name, "*.")
+		lookupName := strings.TrimPrefix(name, "*.")
+
+		records, foundAt, err := relevantCAA(ctx, lookupName, cache)
+		if err != nil {
+			log.Printf("Could not look up the CAA records for %s, leaving it to the CA, error: %s", name, err)
+			continue
+		}
+		if len(records) == 0 {
+			log.Debugf("No CAA records for %s, any CA can issue", name)
+			continue
+		}
+
+		var issue, issueWild []caaRecord
+		for _, record := range records {
+			switch record.tag {
+			case "issue":
+				issue = append(issue, record)
+			case "issuewild":
+				issueWild = append(issueWild, record)
+			default:
+				if record.flags&128 != 0 && !knownCAATags[record.tag] {
+					return caaError{errors.New(fmt.Sprintf("the CAA records at %s have the unknown critical tag %s", foundAt, record.tag))}
+				}
+			}
+		}
+		// issuewild takes over from issue for wildcards if there are any
+		relevant := issue
+		if wildcard && len(issueWild) > 0 {
+			relevant = issueWild
+		}
+		if len(relevant) == 0 {
+			continue
+		}
+
+		allowed := false
+		for _, record := range relevant {
+			if issueAllows(record, identities, ca.accountURI()) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return caaError{errors.New(fmt.Sprintf("the CAA records at %s do not allow %s (%s) to issue for %s with this account using dns-01",
+				foundAt, ca.Name, strings.Join(identities, ", "), name))}
+		}
+		log.Debugf("The CAA records at %s allow %s to issue for %s", foundAt, ca.Name, name)
+	}
+	return nil
+}
+
+func caaContent(tag string, value string) string {
+	return fmt.Sprintf("0 %s \"%s\"", tag, value)
+}
+
+// Adds the issue records for the CAs in use to each tenant domain.
+// Records already there are left alone, including ones for other CAs.
+func writeCAARecords() {
+	if Cfg.ACME.Staging {
+		log.Fatal("The staging accounts are not the real ones, write the CAA records without -staging")
+	}
+
+	var values []string
+	for _, ca := range caOrder {
+		identities := ca.caaIdentities(context.Background())
+		if len(identities) == 0 {
+			log.Printf("No CAA identity known for %s, set caaIdentities for it", ca.Name)
+			continue
+		}
+		if ca.accountURI() == "" {
+			log.Printf("The account with %s isn't registered, its CAA record can't be locked to it", ca.Name)
+			continue
+		}
+		values = append(values, fmt.Sprintf("%s; accounturi=%s; validationmethods=dns-01", identities[0], ca.accountURI()))
+	}
+	if len(values) == 0 {
+		log.Fatal("There are no CAA records to write")
+	}
+
+	done := map[string]bool{}
+	for _, t := range tenants {
+		for _, domain := range append([]string{t.Domain}, t.ExtraNames.ExtraDomains...) {
+			if done[domain] {
+				continue
+			}
+			done[domain] = true
+			if err := addCAARecords(domain, values); err != nil {
+				log.Printf("Could not write the CAA records for %s, error: %s", domain, err)
+			}
+		}
+	}
+}
+
+func addCAARecords(domain string, values []string) error {
+	zone, err := zoneFor(domain)
+	if err != nil {
+		return err
+	}
+	recs, err := zone.api.DNSRecords(zone.id, cloudflare.DNSRecord{Type: "CAA", Name: domain})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Searching for existing records failed: %s", err))
+	}
+	existing := map[string]bool{}
+	for _, r := range recs {
+		log.Printf("Existing CAA record for %s: %s", domain, r.Content)
+		existing[r.Content] = true
+	}
+
+	for _, value := range values {
+		content := caaContent("issue", value)
+		if existing[content] {
+			log.Printf("The CAA record for %s is already there: %s", domain, content)
+			continue
+		}
+		log.Printf("Adding the CAA record for %s: %s", domain, content)
+		record := cloudflare.DNSRecord{
+			Type: "CAA",
+			Name: domain,
+			Data: map[string]interface{}{"flags": 0, "tag": "issue", "value": value},
+		}
+		if _, err := zone.api.CreateDNSRecord(zone.id, record); err != nil {
+			return errors.New(fmt.Sprintf("Failed to add the CAA record: %s", err))
+		}
+	}
+	return nil
+}
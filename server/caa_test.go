@@ -0,0 +1,90 @@
+package main
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"testing"
+)
+
+func TestParseCAA(t *testing.T) {
+	tests := []struct {
+		data    []byte
+		want    caaRecord
+		wantErr bool
+	}{
+		{append([]byte{0, 5}, "issueletsencrypt.org"...), caaRecord{0, "issue", "letsencrypt.org"}, false},
+		{append([]byte{128, 9}, "ISSUEWILD;"...), caaRecord{128, "issuewild", ";"}, false},
+		{append([]byte{0, 5}, "issue"...), caaRecord{0, "issue", ""}, false},
+		{[]byte{0}, caaRecord{}, true},
+		{append([]byte{0, 9}, "issue"...), caaRecord{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseCAA(test.data)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCAA(%q) error = %v, want error %t", test.data, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseCAA(%q) = %+v, want %+v", test.data, got, test.want)
+		}
+	}
+}
+
+func TestIssueAllows(t *testing.T) {
+	identities := []string{"letsencrypt.org"}
+	account := "https://acme.example/acct/1"
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"letsencrypt.org", true},
+		{"LetsEncrypt.org", true},
+		{"sectigo.com", false},
+		{";", false},
+		{"letsencrypt.org; accounturi=https://acme.example/acct/1", true},
+		{"letsencrypt.org; accounturi=https://acme.example/acct/2", false},
+		{"letsencrypt.org; validationmethods=http-01,dns-01", true},
+		{"letsencrypt.org; validationmethods=http-01", false},
+		{"letsencrypt.org; accounturi=https://acme.example/acct/1; validationmethods=dns-01", true},
+	}
+	for _, test := range tests {
+		if got := issueAllows(caaRecord{tag: "issue", value: test.value}, identities, account); got != test.want {
+			t.Errorf("issueAllows(%q) = %t, want %t", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAnswersQuery(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	question := dnsmessage.Question{Name: name, Type: typeCAA, Class: dnsmessage.ClassINET}
+	sent := dnsmessage.Message{Header: dnsmessage.Header{ID: 42}, Questions: []dnsmessage.Question{question}}
+
+	answer := func(id uint16, response bool, questions ...dnsmessage.Question) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{ID: id, Response: response}, Questions: questions}
+	}
+	upper := question
+	upper.Name = dnsmessage.MustNewName("EXAMPLE.com.")
+	otherName := question
+	otherName.Name = dnsmessage.MustNewName("example.net.")
+	otherType := question
+	otherType.Type = dnsmessage.TypeTXT
+
+	tests := []struct {
+		name     string
+		response dnsmessage.Message
+		want     bool
+	}{
+		{"matches", answer(42, true, question), true},
+		{"case differs", answer(42, true, upper), true},
+		{"wrong ID", answer(43, true, question), false},
+		{"not a response", answer(42, false, question), false},
+		{"no question", answer(42, true), false},
+		{"two questions", answer(42, true, question, question), false},
+		{"wrong name", answer(42, true, otherName), false},
+		{"wrong type", answer(42, true, otherType), false},
+	}
+	for _, test := range tests {
+		if got := answersQuery(sent, test.response); got != test.want {
+			t.Errorf("%s: answersQuery = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -12,40 +12,122 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 	"time"
 )
 
 import log "github.com/sirupsen/logrus"
 
-func GenerateCertificate(csrKeyBytes []byte, fqdn string) ([][]byte, error) {
-	log.Debugf("Hostname in certificate generation request: %s", fqdn)
+const letsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+const letsEncryptStagingDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
 
-	log.Debug("Generating the Lets Encrypt account key")
-	// All the usual account registration prelude
-	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// Returned when the CA says one of its rate limits has been hit
+type rateLimitedError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e rateLimitedError) Error() string {
+	return fmt.Sprintf("Rate limited by the CA, retry after %s, error: %s", e.retryAfter, e.err)
+}
+
+// Returned when the CA can't be reached or has an error of its own, the
+// next CA is worth trying
+type caUnavailableError struct {
+	err error
+}
+
+func (e caUnavailableError) Error() string {
+	return fmt.Sprintf("The CA is unavailable, error: %s", e.err)
+}
+
+// Picks out rateLimited problem documents so the caller can try again
+// later rather than failing, and network or server errors so another CA
+// can be tried
+func acmeError(msg string, err error) error {
+	if retryAfter, ok := acme.RateLimit(err); ok {
+		log.Printf("The CA is rate limiting us, retry after %s", retryAfter)
+		return rateLimitedError{retryAfter: retryAfter, err: err}
+	}
+	if acmeErr, ok := err.(*acme.Error); ok && acmeErr.StatusCode >= 500 {
+		return caUnavailableError{errors.New(fmt.Sprintf("%s, error: %s", msg, err))}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return caUnavailableError{errors.New(fmt.Sprintf("%s, error: %s", msg, err))}
+	}
+	return errors.New(fmt.Sprintf("%s, error: %s", msg, err))
+}
 
-	client := &acme.Client{
-		Key:          accountKey,
-		DirectoryURL: "https://acme-v01.api.letsencrypt.org/directory",
+func loadOrCreateAccountKey(filename string) (*ecdsa.PrivateKey, error) {
+	if keyPEM, err := ioutil.ReadFile(filename); err == nil {
+		log.Debugf("Loading the account key from: %s", filename)
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New(fmt.Sprintf("No key found in %s", filename))
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	log.Debug("Generating the ACME account key")
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(accountKey)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Debugf("Registering the account")
-	if _, err := client.Register(context.Background(), &acme.Account{},
-		func(tos string) bool {
-			log.Debugf("Agreeing to ToS: %s", tos)
-			return true
-		}); err != nil {
-		log.Fatalf("Can't register an ACME account, error: ", err)
+	log.Debugf("Writing the account key to: %s", filename)
+	outFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+	if err := pem.Encode(outFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return nil, err
 	}
+	return accountKey, nil
+}
 
-	// Authorize a DNS name
-	log.Debug("Authorising the account")
-	authz, err := client.Authorize(context.Background(), fqdn)
+// How long to wait for the TXT records to be seen by the public
+// resolver and how often to look
+const challengePropagationTimeout = 2 * time.Minute
+const challengePropagationInterval = 5 * time.Second
+
+// A DNS-01 challenge still to be done. label is the name the CA looks up,
+// record is where the TXT record goes which is different if the label
+// is delegated.
+type dnsChallenge struct {
+	authz  *acme.Authorization
+	chal   *acme.Challenge
+	label  string
+	record string
+	value  string
+}
+
+// Fetches the authorization and works out its challenge, nil if it is
+// already valid
+func pendingChallenge(ctx context.Context, ca *certificateAuthority, authzURL string) (*dnsChallenge, error) {
+	authz, err := ca.client.GetAuthorization(ctx, authzURL)
 	if err != nil {
-		log.Fatalf("Can't authorize, error: ", err)
+		return nil, acmeError("Can't fetch the authorization", err)
+	}
+	if authz.Status == acme.StatusValid {
+		log.Debugf("Already authorised for %s", authz.Identifier.Value)
+		return nil, nil
+	}
+	if authz.Wildcard {
+		log.Debugf("The authorization is for the wildcard under %s", authz.Identifier.Value)
 	}
 
 	log.Debug("Find the DNS challenge for this authorization")
@@ -57,63 +139,215 @@ func GenerateCertificate(csrKeyBytes []byte, fqdn string) ([][]byte, error) {
 		}
 	}
 	if chal == nil {
-		log.Fatal("No DNS challenge was present")
+		return nil, errors.New("No DNS challenge was present")
 	}
 
 	log.Debug("Determine the TXT record values for the DNS challenge")
+	record, err := challengeRecordName(ctx, authz.Identifier.Value)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ca.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsChallenge{
+		authz:  authz,
+		chal:   chal,
+		label:  "_acme-challenge." + authz.Identifier.Value,
+		record: record,
+		value:  value,
+	}, nil
+}
+
+// Does the challenges for all the order's authorizations together. The
+// apex name and its wildcard share _acme-challenge.<name> so each gets
+// its own TXT record there. All of them are published and seen by the
+// public resolver before any challenge is accepted, then removed once
+// the CA has checked them.
+func completeAuthorizations(ctx context.Context, ca *certificateAuthority, authzURLs []string) error {
+	var challenges []*dnsChallenge
+	for _, authzURL := range authzURLs {
+		challenge, err := pendingChallenge(ctx, ca, authzURL)
+		if err != nil {
+			return err
+		}
+		if challenge != nil {
+			challenges = append(challenges, challenge)
+		}
+	}
+	if len(challenges) == 0 {
+		return nil
+	}
 
-	txtLabel := "_acme-challenge." + authz.Identifier.Value
-	txtValue, _ := client.DNS01ChallengeRecord(chal.Token)
-	log.Debugf("Creating record %s with value %s", txtLabel, txtValue)
+	defer func() {
+		for _, challenge := range challenges {
+			if err := DeleteDNSRecordContent("TXT", challenge.record, challenge.value); err != nil {
+				log.Printf("Could not remove the challenge record %s, error: %s", challenge.record, err)
+			}
+		}
+	}()
 
-	CreateOrUpdateDNSRecord("TXT", txtLabel, txtValue)
+	for _, challenge := range challenges {
+		log.Debugf("Creating record %s with value %s", challenge.record, challenge.value)
+		if err := AddDNSRecord("TXT", challenge.record, challenge.value); err != nil {
+			return err
+		}
+	}
 
-	// It can take a few seconds from creation to becoming visible
-	// so a quick sleep then check it was created
+	// It can take a while from creation to becoming visible so check the
+	// values can be seen the way the CA will look for them
+	for _, challenge := range challenges {
+		if err := waitForTXT(ctx, challenge.label, challenge.value); err != nil {
+			return err
+		}
+	}
+	log.Debug("TXT records created and all is good")
 
-	log.Debug("Sleeping 5 seconds to ensure TXT record is setup correctly")
-	time.Sleep(5 * time.Second)
-	log.Debug("Sleep over")
+	// Accept the challenges, wait for the authorizations ...
+	for _, challenge := range challenges {
+		if _, err := ca.client.Accept(ctx, challenge.chal); err != nil {
+			return acmeError("Can't accept challenge", err)
+		}
+	}
 
-	success := false
-	for i := 0; i < 3; i++ {
-		res := CheckRecord("TXT", txtLabel)
-		if res {
-			success = true
-			break
+	for _, challenge := range challenges {
+		var err error
+		success := false
+		for i := 0; i < 3; i++ {
+			if _, err = ca.client.WaitAuthorization(ctx, challenge.authz.URI); err == nil {
+				success = true
+				break
+			}
+			log.Debugf("Failed authorization, error: %s", err)
+			log.Debugf("Sleeping on retry %d", i)
+			time.Sleep(2 * time.Second)
+		}
+		if !success {
+			return acmeError("Failed authorization", err)
 		}
-		log.Debugf("TXT record not yet there, sleeping on retry %d", i)
-		time.Sleep(5 * time.Second)
 	}
+	return nil
+}
 
-	if !success {
-		log.Fatal("TXT record not created")
+func waitForTXT(ctx context.Context, name string, value string) error {
+	deadline := time.Now().Add(challengePropagationTimeout)
+	for i := 0; ; i++ {
+		if CheckTXTRecord(ctx, name, value) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("The TXT record for %s could not be seen after %s", name, challengePropagationTimeout))
+		}
+		log.Debugf("TXT record for %s not yet there, sleeping on retry %d", name, i)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(challengePropagationInterval):
+		}
 	}
-	log.Debug("TXT Record created and all is good")
+}
 
-	// Accept the challenge, wait for the authorization ...
-	if _, err := client.Accept(context.Background(), chal); err != nil {
-		log.Fatal("Can't accept challenge: ", err)
+// Tries each CA in priority order, moving on to the next if one is
+// unreachable, has server errors or is rate limiting. Anything else, such
+// as the challenge failing, would fail at every CA so is returned
+// straight away. The CA which issued the certificate is returned with it.
+//
+// The names are those the CSR has been checked to contain, wildcards
+// such as *.host.example.com are authorised through DNS-01 like any other.
+// If a profile is given, CAs which don't offer it are skipped.
+//
+// The context is the request's for a certificate issued while the client
+// waits, so the order is given up if the client goes away.
+func GenerateCertificate(ctx context.Context, csrKeyBytes []byte, names []string, profile string) ([][]byte, *certificateAuthority, error) {
+	log.Debugf("Names in certificate generation request: %s", strings.Join(names, ", "))
+
+	var limited *rateLimitedError
+	var failures []string
+	unavailable := false
+	for _, ca := range caOrder {
+		certs, err := ca.order(ctx, csrKeyBytes, names, profile)
+		if err == nil {
+			log.Printf("Certificate issued by %s", ca.Name)
+			return certs, ca, nil
+		}
+		switch e := err.(type) {
+		case rateLimitedError:
+			if limited == nil || e.retryAfter < limited.retryAfter {
+				limited = &e
+			}
+		case caUnavailableError:
+			unavailable = true
+		case errProfileNotOffered:
+		case caaError:
+		default:
+			return nil, nil, err
+		}
+		log.Printf("Could not order from %s, trying the next CA, error: %s", ca.Name, err)
+		failures = append(failures, fmt.Sprintf("%s: %s", ca.Name, err))
 	}
 
-	success = false
-	for i := 0; i < 3; i++ {
-		if _, err = client.WaitAuthorization(context.Background(), authz.URI); err == nil {
-			success = true
-			break
+	// If any of them will issue later, wait for that
+	if limited != nil {
+		return nil, nil, *limited
+	}
+	err := errors.New(fmt.Sprintf("No CA could issue the certificate, %s", strings.Join(failures, ", ")))
+	// Worth trying again later if any of them was only down
+	if unavailable {
+		return nil, nil, caUnavailableError{err}
+	}
+	return nil, nil, err
+}
+
+func (ca *certificateAuthority) order(ctx context.Context, csrKeyBytes []byte, names []string, profile string) ([][]byte, error) {
+	log.Debugf("Ordering from %s", ca.Name)
+
+	// CAs that were down at start up won't have an account yet
+	if ca.accountURI() == "" {
+		if err := ca.register(ctx); err != nil {
+			return nil, acmeError("Can't register the account", err)
+		}
+	}
+
+	// The account URI is needed to check any accounturi pins
+	if err := ca.checkCAA(ctx, names); err != nil {
+		return nil, err
+	}
+
+	// Counted whether or not the order goes on to issue, the CA counts it
+	if err := reserveOrder(ca); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Creating the order")
+	var order *acme.Order
+	var err error
+	if profile != "" {
+		order, err = ca.authorizeOrderWithProfile(ctx, names, profile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		order, err = ca.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+		if err != nil {
+			return nil, acmeError("Can't create the order", err)
 		}
-		log.Debugf("Failed authorization, error: %s", err)
-		log.Debugf("Sleeping on retry %d", i)
-		time.Sleep(2 * time.Second)
 	}
-	if !success {
-		log.Fatal("Failed authorization")
+
+	if err := completeAuthorizations(ctx, ca, order.AuthzURLs); err != nil {
+		return nil, err
 	}
-	ctx := context.TODO()
-	certs, url, err := client.CreateCert(ctx, csrKeyBytes, (90 * time.Minute * 60 * 24), true)
+
+	log.Debug("Waiting for the order to be ready")
+	order, err = ca.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, acmeError("The order failed", err)
+	}
+
+	certs, url, err := ca.client.CreateOrderCert(ctx, order.FinalizeURL, csrKeyBytes, true)
 
 	if err != nil {
-		log.Fatalf(fmt.Sprintf("Got an error when creating the certificate, error: %s", err))
+		return nil, acmeError("Got an error when creating the certificate", err)
 	}
 
 	log.Debugf("The URL is: %s", url)
@@ -121,7 +355,7 @@ func GenerateCertificate(csrKeyBytes []byte, fqdn string) ([][]byte, error) {
 
 	if len(certs) > 0 {
 		// Need to return all certs
-		return certs, nil
+		return ca.preferredChain(ctx, certs, url), nil
 	}
 
 	log.Debug("No certificates returned")
@@ -0,0 +1,97 @@
+package main
+
+/*
+Delegated DNS-01 challenges, in the style of acme-dns.
+
+Rather than giving the server credentials for the main zones, the
+operator points _acme-challenge.<name> at a fixed name in a zone set
+aside for validation, the name itself under the challenge zone:
+
+	_acme-challenge.device1.example.com. CNAME device1.example.com.acme.example.net.
+
+and gives the server credentials for that zone alone in [challengeZone].
+The CA follows the CNAME when it validates, so the TXT record is written
+to the target. Propagation is checked by looking up the _acme-challenge
+name through [acme] challengeResolver, which follows the CNAME the same
+way. The CNAME each name needs is logged when a client registers.
+
+Names without the CNAME have their TXT record written in place as
+before, which needs the main zone's credentials. Without them the
+server can't publish address records either so registrations with the
+tenant are refused.
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// The pure Go resolver asks for the CNAME itself so gets an answer even
+// when the target has no records yet
+var challengeResolver = &net.Resolver{PreferGo: true}
+
+// Where _acme-challenge.<name> has to point. The wildcard shares the
+// apex name's target as it does its _acme-challenge name.
+func challengeTarget(name string) string {
+	return strings.TrimPrefix(name, "*.") + "." + Cfg.ChallengeZone.Domain
+}
+
+// The record the operator has to create for the name, as it would go in
+// a zone file
+func challengeCNAME(name string) string {
+	return fmt.Sprintf("_acme-challenge.%s. CNAME %s.", strings.TrimPrefix(name, "*."), challengeTarget(name))
+}
+
+// Logs the CNAMEs needed for the names, once each, when there is a
+// challenge zone
+func logChallengeCNAMEs(names []string) {
+	if Cfg.ChallengeZone.Domain == "" {
+		return
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		cname := challengeCNAME(name)
+		if !seen[cname] {
+			seen[cname] = true
+			log.Printf("For DNS-01 validation create: %s", cname)
+		}
+	}
+}
+
+// Works out where the TXT record for the name's challenge has to go, the
+// fixed target in the challenge zone if _acme-challenge.<name> is a CNAME
+// to it, otherwise in place. The lookup is given up with the order.
+func challengeRecordName(ctx context.Context, name string) (string, error) {
+	name = strings.TrimPrefix(name, "*.")
+	label := "_acme-challenge." + name
+	if Cfg.ChallengeZone.Domain == "" {
+		return label, nil
+	}
+	target := challengeTarget(name)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cname, err := challengeResolver.LookupCNAME(ctx, label)
+	cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+	if err != nil || cname == "" || cname == label {
+		log.Debugf("%s is not delegated, error: %v", label, err)
+		// In place needs the main zone's credentials
+		if zone, zoneErr := zoneFor(label); zoneErr == nil && zone != zones[Cfg.ChallengeZone.Domain] {
+			log.Debugf("Writing the challenge for %s in place", name)
+			return label, nil
+		}
+		return "", errors.New(fmt.Sprintf("%s is not delegated and the server can't write to its zone, create: %s", label, challengeCNAME(name)))
+	}
+
+	if cname != target {
+		return "", errors.New(fmt.Sprintf("%s is a CNAME to %s, it should be: %s", label, cname, challengeCNAME(name)))
+	}
+	log.Debugf("%s is delegated to %s", label, target)
+	return target, nil
+}
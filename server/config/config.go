@@ -1,5 +1,9 @@
 package config
 
+import "errors"
+import "fmt"
+import "strings"
+import "github.com/digininja/ots-cert-demo/interop"
 import log "github.com/sirupsen/logrus"
 import "github.com/BurntSushi/toml"
 
@@ -9,6 +13,13 @@ type webServer struct {
 	CertFilename string
 	KeyFilename  string
 	CSRFilename  string
+	// The largest request body accepted, in bytes
+	MaxBodyBytes int64
+	// In seconds. The write timeout covers the whole request so has to
+	// allow for a certificate being issued while the client waits.
+	ReadTimeout  int
+	WriteTimeout int
+	IdleTimeout  int
 }
 
 type cloudflareCreds struct {
@@ -16,22 +27,341 @@ type cloudflareCreds struct {
 	API_Key   string
 }
 
-type Config struct {
+type database struct {
+	Path string
+	// In milliseconds, how long a connection waits on a locked database
+	// before giving up
+	BusyTimeout     int
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime int
+}
+
+type Hostnames struct {
+	// names, serial, random, model or vanity
+	Generator string
+	// Vendor prefix for the random generator, also used by the serial
+	// generator and as the fallback for the model generator
+	Prefix string
+	// Added to the serial number before it is hashed
+	Salt         string
+	RandomLength int
+
+	// Policy for hostnames requested by the client. A pointer so a
+	// tenant can turn it off when the top level turns it on.
+	AllowRequested *bool
+	MinLength      int
+	MaxLength      int
+	// Names exactly matching these are refused
+	Reserved []string
+	// Names containing any of these are refused, e.g. profanity
+	Blocklist []string
+}
+
+// Whether requested hostnames are tried, false if it isn't set
+func (h Hostnames) RequestedAllowed() bool {
+	return h.AllowRequested != nil && *h.AllowRequested
+}
+
+type rateLimits struct {
+	// Token buckets for each source IP and each client ID
+	IPPerMinute     float64
+	IPBurst         int
+	ClientPerMinute float64
+	ClientBurst     int
+	// Certificates per registered domain in a rolling week, Let's
+	// Encrypt allows 50
+	WeeklyCertificates int
+	// New orders for the ACME account in three hours, Let's Encrypt
+	// allows 300
+	AccountOrders int
+	// In seconds, how often the queue of certificate requests waiting
+	// on the limits is checked
+	QueueInterval int
+}
+
+// An ACME CA certificates can be ordered from
+type CAProfile struct {
+	Name string
+	// Can be left empty for letsencrypt, zerossl and buypass
+	DirectoryURL string
+	// Used instead of DirectoryURL in staging mode, can be left empty
+	// for letsencrypt and buypass. CAs without one are skipped in
+	// staging mode.
+	StagingDirectoryURL string
+	// External Account Binding, needed by ZeroSSL and some private CAs.
+	// The HMAC key is base64url encoded as the CA gives it out.
+	EABKeyID   string
+	EABHMACKey string
+	// Contact address for the account, used for expiry and problem emails
+	Email string
+	// Common name of the root or intermediate the chain should end at
+	// when the CA offers more than one
+	PreferredChain string
+	// PEM file of roots to trust when talking to the directory, for
+	// private CAs such as step-ca
+	TrustedRoots string
+	// Defaults to acme-<name>.key
+	AccountKeyFilename string
+	// The issuer domains the CA matches in CAA records, if empty they are
+	// taken from the directory
+	CAAIdentities []string
+}
+
+type acme struct {
+	// Created on first run and reused after that, used for the built in
+	// Let's Encrypt profile when no CAs are configured
+	AccountKeyFilename string
+	// The name of the CA to order from
+	CA string
+	// Use the CAs' staging environments, for development. Also set by
+	// --staging
+	Staging bool
+	// CA names in the order to try them, if one is down or rate limiting
+	// the next is used. If empty, only CA is used.
+	Failover []string
+	// Check the CAA records allow the CA before ordering, looked up
+	// through CAAResolver so the answer is the one the public sees
+	CheckCAA    bool
+	CAAResolver string
+	// DNS-01 TXT records are looked up here to see they have propagated
+	// before the CA is told to check them
+	ChallengeResolver string
+	CAs               []CAProfile
+}
+
+type admin struct {
+	// Bearer token for the /admin endpoints, if empty they are disabled
+	Token string
+}
+
+// Extra names, as SANs, that clients can have on their certificates
+// along with their hostname
+type extraNames struct {
+	// Let the client ask for a short alias under the tenant domain
+	AllowAlias bool
+	// Add a name made from the serial number the client sends, e.g.
+	// sn-abc123
+	SerialNames  bool
+	SerialPrefix string
+	// The hostname is also issued under each of these domains, they have
+	// to be in the tenant's Cloudflare account
+	ExtraDomains []string
+}
+
+// CIDRs client addresses are checked against when registering, deny
+// wins over allow and an empty allow list allows anything
+type registrationIPs struct {
+	Allow []string
+	Deny  []string
+}
+
+// Anything missing from a tenant's hostnames or cloudflareCreds section
+// is taken from the top level of the config
+type Tenant struct {
+	Name   string
+	Domain string
+	// A client has to send one of these to register with the tenant
+	EnrollmentTokens []string
+	// Maximum number of clients that can be registered, 0 is no limit
+	MaxClients int
+	// Issue *.hostname.domain along with hostname.domain and publish
+	// wildcard address records, for devices with virtual hosts
+	Wildcard   bool
+	ExtraNames extraNames
+	// The ACME certificate profile to order, such as shortlived, empty
+	// for the CA's default
+	CertificateProfile string
+	CloudflareCreds    cloudflareCreds
+	Hostnames          Hostnames
+	RegistrationIPs    registrationIPs
+}
+
+// A zone that only holds challenge TXT records, _acme-challenge names in
+// the main zones are CNAMEs into it. The credentials only need access to
+// this zone.
+type challengeZone struct {
 	Domain          string
-	Hostname        string
-	Interface       string
 	CloudflareCreds cloudflareCreds
-	WebServer       webServer
+}
+
+// Used to pick the IP addresses to register when the device has more
+// than one, see interop.IPPolicy
+type ipSelection struct {
+	Allow          []string
+	Deny           []string
+	SkipInterfaces []string
+}
+
+type Config struct {
+	Domain      string
+	Hostname    string
+	Interface   string
+	IPSelection ipSelection
+	// How many generated hostnames to try before giving up
+	HostnameAttempts int
+	// These apply to the default tenant which is made up from the
+	// top level settings, if empty anyone can register with it
+	EnrollmentTokens []string
+	MaxClients       int
+	Wildcard         bool
+	ExtraNames       extraNames
+	// Only used for client certificates, the server's own certificate
+	// always has the CA's default profile
+	CertificateProfile string
+	CloudflareCreds    cloudflareCreds
+	ChallengeZone      challengeZone
+	WebServer          webServer
+	// Subject fields for the server's own CSR
+	CSRSubject      interop.CSRSubject
+	Database        database
+	Hostnames       Hostnames
+	RegistrationIPs registrationIPs
+	RateLimits      rateLimits
+	ACME            acme
+	Admin           admin
+	Tenants         []Tenant
 }
 
 func NewConfig(configFile string) (cfg Config, err error) {
+	cfg.setDefaults()
 	err = cfg.parseFile(configFile)
 	if err != nil {
 		return cfg, err
 	}
+	if err = cfg.validate(); err != nil {
+		return cfg, err
+	}
+	cfg.inheritTenantSettings()
+	cfg.setCADefaults()
 	return cfg, nil
 }
 
+// Settings which would break the web server in odd ways if they were
+// zero or negative, net/http takes a zero timeout as no timeout at all
+func (cfg *Config) validate() error {
+	if cfg.WebServer.MaxBodyBytes <= 0 {
+		return errors.New(fmt.Sprintf("webServer maxBodyBytes must be more than 0, got: %d", cfg.WebServer.MaxBodyBytes))
+	}
+	timeouts := map[string]int{
+		"readTimeout":  cfg.WebServer.ReadTimeout,
+		"writeTimeout": cfg.WebServer.WriteTimeout,
+		"idleTimeout":  cfg.WebServer.IdleTimeout,
+	}
+	for _, name := range []string{"readTimeout", "writeTimeout", "idleTimeout"} {
+		if timeouts[name] <= 0 {
+			return errors.New(fmt.Sprintf("webServer %s must be more than 0, got: %d", name, timeouts[name]))
+		}
+	}
+	// The scheduler's ticker can't take zero
+	if cfg.RateLimits.QueueInterval <= 0 {
+		return errors.New(fmt.Sprintf("rateLimits queueInterval must be more than 0, got: %d", cfg.RateLimits.QueueInterval))
+	}
+	return nil
+}
+
+// Anything not in the config file keeps these values
+func (cfg *Config) setDefaults() {
+	cfg.HostnameAttempts = 20
+	cfg.WebServer.MaxBodyBytes = 64 * 1024
+	cfg.WebServer.ReadTimeout = 15
+	cfg.WebServer.WriteTimeout = 300
+	cfg.WebServer.IdleTimeout = 120
+	cfg.RegistrationIPs.Allow = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+	cfg.RateLimits.IPPerMinute = 30
+	cfg.RateLimits.IPBurst = 10
+	cfg.RateLimits.ClientPerMinute = 6
+	cfg.RateLimits.ClientBurst = 3
+	cfg.RateLimits.WeeklyCertificates = 50
+	cfg.RateLimits.AccountOrders = 300
+	cfg.RateLimits.QueueInterval = 60
+	cfg.ACME.AccountKeyFilename = "acme-account.key"
+	cfg.ACME.CA = "letsencrypt"
+	cfg.ACME.CheckCAA = true
+	cfg.ACME.CAAResolver = "1.1.1.1:53"
+	cfg.ACME.ChallengeResolver = "1.1.1.1:53"
+	cfg.ExtraNames.SerialPrefix = "sn-"
+	cfg.Hostnames.Generator = "names"
+	cfg.Hostnames.RandomLength = 10
+	cfg.Hostnames.MinLength = 3
+	cfg.Hostnames.MaxLength = 63
+	cfg.Database.Path = "./ots-cert.db"
+	cfg.Database.BusyTimeout = 5000
+	cfg.Database.MaxOpenConns = 10
+	cfg.Database.MaxIdleConns = 5
+	cfg.Database.ConnMaxLifetime = 3600
+}
+
+// Without any CAs configured, Let's Encrypt is used with the original
+// account key. So is a letsencrypt profile without a key of its own, so
+// adding the profile doesn't make a new account.
+func (cfg *Config) setCADefaults() {
+	if len(cfg.ACME.CAs) == 0 {
+		cfg.ACME.CAs = []CAProfile{{Name: "letsencrypt", AccountKeyFilename: cfg.ACME.AccountKeyFilename}}
+	}
+	for i := range cfg.ACME.CAs {
+		ca := &cfg.ACME.CAs[i]
+		if ca.AccountKeyFilename != "" {
+			continue
+		}
+		if strings.ToLower(ca.Name) == "letsencrypt" {
+			ca.AccountKeyFilename = cfg.ACME.AccountKeyFilename
+		} else {
+			ca.AccountKeyFilename = fmt.Sprintf("acme-%s.key", ca.Name)
+		}
+	}
+}
+
+func (cfg *Config) inheritTenantSettings() {
+	for i := range cfg.Tenants {
+		t := &cfg.Tenants[i]
+		if t.CloudflareCreds.API_Key == "" {
+			t.CloudflareCreds = cfg.CloudflareCreds
+		}
+		// Each list is taken on its own so a tenant that only adds to the
+		// deny list keeps the top level allow list. An empty list given in
+		// the file isn't nil so allow = [] still allows anything.
+		if t.RegistrationIPs.Allow == nil {
+			t.RegistrationIPs.Allow = cfg.RegistrationIPs.Allow
+		}
+		if t.RegistrationIPs.Deny == nil {
+			t.RegistrationIPs.Deny = cfg.RegistrationIPs.Deny
+		}
+		if t.ExtraNames.SerialPrefix == "" {
+			t.ExtraNames.SerialPrefix = cfg.ExtraNames.SerialPrefix
+		}
+		// As with the lists above, field by field so a tenant that only
+		// sets a blocklist keeps everything else
+		if t.Hostnames.Generator == "" {
+			t.Hostnames.Generator = cfg.Hostnames.Generator
+		}
+		if t.Hostnames.Prefix == "" {
+			t.Hostnames.Prefix = cfg.Hostnames.Prefix
+		}
+		if t.Hostnames.Salt == "" {
+			t.Hostnames.Salt = cfg.Hostnames.Salt
+		}
+		if t.Hostnames.AllowRequested == nil {
+			t.Hostnames.AllowRequested = cfg.Hostnames.AllowRequested
+		}
+		if t.Hostnames.Reserved == nil {
+			t.Hostnames.Reserved = cfg.Hostnames.Reserved
+		}
+		if t.Hostnames.Blocklist == nil {
+			t.Hostnames.Blocklist = cfg.Hostnames.Blocklist
+		}
+		if t.Hostnames.RandomLength == 0 {
+			t.Hostnames.RandomLength = cfg.Hostnames.RandomLength
+		}
+		if t.Hostnames.MinLength == 0 {
+			t.Hostnames.MinLength = cfg.Hostnames.MinLength
+		}
+		if t.Hostnames.MaxLength == 0 {
+			t.Hostnames.MaxLength = cfg.Hostnames.MaxLength
+		}
+	}
+}
+
 func (cfg *Config) parseFile(configFile string) error {
 	if _, err := toml.DecodeFile(configFile, &cfg); err != nil {
 		return err
@@ -44,12 +374,87 @@ func (cfg Config) Dump() {
 	log.Printf("Cloudflare user: %s", cfg.CloudflareCreds.API_Email)
 	log.Printf("Cloudflare key: %s", cfg.CloudflareCreds.API_Key)
 	log.Printf("Domain: %s", cfg.Domain)
+	log.Printf("Challenge zone: %s", cfg.ChallengeZone.Domain)
+	log.Printf("Challenge zone Cloudflare user: %s", cfg.ChallengeZone.CloudflareCreds.API_Email)
 	log.Printf("Hostname: %s", cfg.Hostname)
 	log.Printf("Interface: %s", cfg.Interface)
+	log.Printf("IP allow list: %s", strings.Join(cfg.IPSelection.Allow, ", "))
+	log.Printf("IP deny list: %s", strings.Join(cfg.IPSelection.Deny, ", "))
+	log.Printf("Skipped interfaces: %s", strings.Join(cfg.IPSelection.SkipInterfaces, ", "))
+	log.Printf("Hostname attempts: %d", cfg.HostnameAttempts)
+	log.Printf("Enrollment tokens: %d", len(cfg.EnrollmentTokens))
+	log.Printf("Max clients: %d", cfg.MaxClients)
+	log.Printf("Wildcard certificates: %t", cfg.Wildcard)
+	log.Printf("Allow aliases: %t", cfg.ExtraNames.AllowAlias)
+	log.Printf("Serial number names: %t, prefix: %s", cfg.ExtraNames.SerialNames, cfg.ExtraNames.SerialPrefix)
+	log.Printf("Extra domains: %s", strings.Join(cfg.ExtraNames.ExtraDomains, ", "))
+	log.Printf("Certificate profile: %s", cfg.CertificateProfile)
 
 	log.Printf("Web server running on IP: %s", cfg.WebServer.IP)
 	log.Printf("Web server running on port: %d", cfg.WebServer.Port)
 	log.Printf("Certificate filename: %d", cfg.WebServer.CertFilename)
 	log.Printf("Private key filename: %d", cfg.WebServer.KeyFilename)
 	log.Printf("CSR filename: %d", cfg.WebServer.CSRFilename)
+	log.Printf("Maximum request size: %d bytes", cfg.WebServer.MaxBodyBytes)
+	log.Printf("Timeouts: read %ds, write %ds, idle %ds", cfg.WebServer.ReadTimeout, cfg.WebServer.WriteTimeout, cfg.WebServer.IdleTimeout)
+	cfg.CSRSubject.Dump()
+
+	log.Printf("Hostname generator: %s", cfg.Hostnames.Generator)
+	log.Printf("Hostname prefix: %s", cfg.Hostnames.Prefix)
+	log.Printf("Hostname random length: %d", cfg.Hostnames.RandomLength)
+	log.Printf("Allow requested hostnames: %t", cfg.Hostnames.RequestedAllowed())
+	log.Printf("Requested hostname length: %d to %d", cfg.Hostnames.MinLength, cfg.Hostnames.MaxLength)
+	log.Printf("Reserved hostnames: %s", strings.Join(cfg.Hostnames.Reserved, ", "))
+	log.Printf("Hostname blocklist: %s", strings.Join(cfg.Hostnames.Blocklist, ", "))
+
+	log.Printf("Registration IP allow list: %s", strings.Join(cfg.RegistrationIPs.Allow, ", "))
+	log.Printf("Registration IP deny list: %s", strings.Join(cfg.RegistrationIPs.Deny, ", "))
+
+	log.Printf("Requests per IP: %.1f a minute, burst %d", cfg.RateLimits.IPPerMinute, cfg.RateLimits.IPBurst)
+	log.Printf("Requests per client: %.1f a minute, burst %d", cfg.RateLimits.ClientPerMinute, cfg.RateLimits.ClientBurst)
+	log.Printf("Certificates per registered domain per week: %d", cfg.RateLimits.WeeklyCertificates)
+	log.Printf("Orders per ACME account per three hours: %d", cfg.RateLimits.AccountOrders)
+	log.Printf("Certificate queue interval (s): %d", cfg.RateLimits.QueueInterval)
+
+	log.Printf("ACME account key filename: %s", cfg.ACME.AccountKeyFilename)
+	log.Printf("ACME CA: %s", cfg.ACME.CA)
+	log.Printf("ACME staging: %t", cfg.ACME.Staging)
+	log.Printf("ACME failover order: %s", strings.Join(cfg.ACME.Failover, ", "))
+	log.Printf("Check CAA records: %t, resolver: %s", cfg.ACME.CheckCAA, cfg.ACME.CAAResolver)
+	log.Printf("Challenge resolver: %s", cfg.ACME.ChallengeResolver)
+	for _, ca := range cfg.ACME.CAs {
+		log.Printf("CA: %s", ca.Name)
+		log.Printf("\tDirectory: %s", ca.DirectoryURL)
+		log.Printf("\tStaging directory: %s", ca.StagingDirectoryURL)
+		log.Printf("\tEAB key ID: %s", ca.EABKeyID)
+		log.Printf("\tEmail: %s", ca.Email)
+		log.Printf("\tPreferred chain: %s", ca.PreferredChain)
+		log.Printf("\tTrusted roots: %s", ca.TrustedRoots)
+		log.Printf("\tAccount key filename: %s", ca.AccountKeyFilename)
+		log.Printf("\tCAA identities: %s", strings.Join(ca.CAAIdentities, ", "))
+	}
+	log.Printf("Admin endpoints enabled: %t", cfg.Admin.Token != "")
+
+	for _, t := range cfg.Tenants {
+		log.Printf("Tenant: %s", t.Name)
+		log.Printf("\tDomain: %s", t.Domain)
+		log.Printf("\tCloudflare user: %s", t.CloudflareCreds.API_Email)
+		log.Printf("\tEnrollment tokens: %d", len(t.EnrollmentTokens))
+		log.Printf("\tMax clients: %d", t.MaxClients)
+		log.Printf("\tWildcard certificates: %t", t.Wildcard)
+		log.Printf("\tAllow aliases: %t", t.ExtraNames.AllowAlias)
+		log.Printf("\tSerial number names: %t, prefix: %s", t.ExtraNames.SerialNames, t.ExtraNames.SerialPrefix)
+		log.Printf("\tExtra domains: %s", strings.Join(t.ExtraNames.ExtraDomains, ", "))
+		log.Printf("\tCertificate profile: %s", t.CertificateProfile)
+		log.Printf("\tHostname generator: %s", t.Hostnames.Generator)
+		log.Printf("\tAllow requested hostnames: %t", t.Hostnames.RequestedAllowed())
+		log.Printf("\tRegistration IP allow list: %s", strings.Join(t.RegistrationIPs.Allow, ", "))
+		log.Printf("\tRegistration IP deny list: %s", strings.Join(t.RegistrationIPs.Deny, ", "))
+	}
+
+	log.Printf("Database path: %s", cfg.Database.Path)
+	log.Printf("Database busy timeout (ms): %d", cfg.Database.BusyTimeout)
+	log.Printf("Database max open connections: %d", cfg.Database.MaxOpenConns)
+	log.Printf("Database max idle connections: %d", cfg.Database.MaxIdleConns)
+	log.Printf("Database connection max lifetime (s): %d", cfg.Database.ConnMaxLifetime)
 }
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		wantErr bool
+	}{
+		{"defaults", func(cfg *Config) {}, false},
+		{"no body", func(cfg *Config) { cfg.WebServer.MaxBodyBytes = 0 }, true},
+		{"negative read timeout", func(cfg *Config) { cfg.WebServer.ReadTimeout = -1 }, true},
+		{"no write timeout", func(cfg *Config) { cfg.WebServer.WriteTimeout = 0 }, true},
+		{"no idle timeout", func(cfg *Config) { cfg.WebServer.IdleTimeout = 0 }, true},
+		{"no queue interval", func(cfg *Config) { cfg.RateLimits.QueueInterval = 0 }, true},
+		{"negative queue interval", func(cfg *Config) { cfg.RateLimits.QueueInterval = -60 }, true},
+	}
+	for _, test := range tests {
+		var cfg Config
+		cfg.setDefaults()
+		test.change(&cfg)
+		if err := cfg.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate = %v, want error %t", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestInheritTenantHostnames(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.cfg")
+	err := ioutil.WriteFile(file, []byte(`
+[hostnames]
+	generator = "random"
+	prefix = "acme"
+	allowRequested = true
+	reserved = ["www"]
+	blocklist = ["rude"]
+
+[[tenants]]
+	name = "blocklist"
+	[tenants.hostnames]
+		blocklist = ["ruder"]
+
+[[tenants]]
+	name = "off"
+	[tenants.hostnames]
+		allowRequested = false
+		reserved = []
+
+[[tenants]]
+	name = "nothing"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		generator      string
+		prefix         string
+		allowRequested bool
+		reserved       []string
+		blocklist      []string
+	}{
+		{"random", "acme", true, []string{"www"}, []string{"ruder"}},
+		{"random", "acme", false, []string{}, []string{"rude"}},
+		{"random", "acme", true, []string{"www"}, []string{"rude"}},
+	}
+	for i, test := range tests {
+		h := cfg.Tenants[i].Hostnames
+		name := cfg.Tenants[i].Name
+		if h.Generator != test.generator || h.Prefix != test.prefix || h.RequestedAllowed() != test.allowRequested {
+			t.Errorf("%s: generator %s, prefix %s, allow requested %t", name, h.Generator, h.Prefix, h.RequestedAllowed())
+		}
+		if !reflect.DeepEqual(h.Reserved, test.reserved) || !reflect.DeepEqual(h.Blocklist, test.blocklist) {
+			t.Errorf("%s: reserved %v, blocklist %v", name, h.Reserved, h.Blocklist)
+		}
+		if h.RandomLength != 10 || h.MinLength != 3 || h.MaxLength != 63 {
+			t.Errorf("%s: lengths %d, %d to %d", name, h.RandomLength, h.MinLength, h.MaxLength)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+/*
+The CSR comes from the client so can't be trusted. Before anything is
+ordered, the names in it are checked against the names the server has
+decided the client can have, it must have exactly those, no more and
+no less. Anything other than DNS names is refused.
+*/
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+import log "github.com/sirupsen/logrus"
+
+func parseCSR(csrBytes []byte) (*x509.CertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not parse the CSR: %s", err))
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New(fmt.Sprintf("The CSR signature is not valid: %s", err))
+	}
+	return csr, nil
+}
+
+// All the DNS names in the CSR, lower case, sorted and with the
+// CommonName included
+func csrNames(csr *x509.CertificateRequest) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, name := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		name = strings.ToLower(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkCSR(csrBytes []byte, allowed []string) error {
+	csr, err := parseCSR(csrBytes)
+	if err != nil {
+		return err
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("The CSR can only contain DNS names")
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range allowed {
+		wanted[strings.ToLower(name)] = true
+	}
+
+	names := csrNames(csr)
+	log.Debugf("Names in the CSR: %s", strings.Join(names, ", "))
+	for _, name := range names {
+		if !wanted[name] {
+			return errors.New(fmt.Sprintf("The CSR contains a name which is not allowed: %s", name))
+		}
+		delete(wanted, name)
+	}
+	for name := range wanted {
+		return errors.New(fmt.Sprintf("The CSR is missing the name: %s", name))
+	}
+	return nil
+}
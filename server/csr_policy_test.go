@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func testCSR(t *testing.T, template x509.CertificateRequest) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestCSRNames(t *testing.T) {
+	tests := []struct {
+		commonName string
+		dnsNames   []string
+		want       []string
+	}{
+		{"host.example.com", []string{"host.example.com"}, []string{"host.example.com"}},
+		{"", []string{"B.example.com", "a.example.com"}, []string{"a.example.com", "b.example.com"}},
+		{"Host.Example.com", []string{"*.host.example.com"}, []string{"*.host.example.com", "host.example.com"}},
+	}
+	for _, test := range tests {
+		csr, err := parseCSR(testCSR(t, x509.CertificateRequest{Subject: pkix.Name{CommonName: test.commonName}, DNSNames: test.dnsNames}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := csrNames(csr); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("csrNames(%q, %v) = %v, want %v", test.commonName, test.dnsNames, got, test.want)
+		}
+	}
+}
+
+func TestCheckCSR(t *testing.T) {
+	allowed := []string{"host.example.com", "*.host.example.com"}
+	tests := []struct {
+		name     string
+		template x509.CertificateRequest
+		ok       bool
+	}{
+		{"exact", x509.CertificateRequest{DNSNames: []string{"host.example.com", "*.host.example.com"}}, true},
+		{"case", x509.CertificateRequest{DNSNames: []string{"HOST.example.com", "*.host.example.com"}}, true},
+		{"missing", x509.CertificateRequest{DNSNames: []string{"host.example.com"}}, false},
+		{"extra", x509.CertificateRequest{DNSNames: []string{"host.example.com", "*.host.example.com", "other.example.com"}}, false},
+		{"common name not allowed", x509.CertificateRequest{Subject: pkix.Name{CommonName: "other.example.com"}, DNSNames: allowed}, false},
+		{"IP address", x509.CertificateRequest{DNSNames: allowed, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+		{"email", x509.CertificateRequest{DNSNames: allowed, EmailAddresses: []string{"a@example.com"}}, false},
+	}
+	for _, test := range tests {
+		err := checkCSR(testCSR(t, test.template), allowed)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: checkCSR = %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+
+	if err := checkCSR([]byte("not a CSR"), allowed); err == nil {
+		t.Error("A CSR that can't be parsed was accepted")
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+/*
+SQLite is run in WAL mode with a busy timeout so that registrations
+can be handled concurrently. Hostname uniqueness is enforced by the
+database rather than by a lock in the web server so the check and the
+insert can't be split by another request.
+*/
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+var database *sql.DB
+
+func initDatabase() {
+	log.Debug("Setting up the database")
+	log.Debugf("Database path: %s", Cfg.Database.Path)
+
+	// Options are described here
+	// https://github.com/mattn/go-sqlite3#connection-string
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", Cfg.Database.Path, Cfg.Database.BusyTimeout)
+
+	var err error
+	database, err = sql.Open("sqlite3", dsn)
+	if err != nil {
+		log.Fatalf("can't connect to the database, error: %s", err)
+	}
+
+	database.SetMaxOpenConns(Cfg.Database.MaxOpenConns)
+	database.SetMaxIdleConns(Cfg.Database.MaxIdleConns)
+	database.SetConnMaxLifetime(time.Duration(Cfg.Database.ConnMaxLifetime) * time.Second)
+
+	log.Debug("Creating the database if required")
+
+	// IP holds a comma separated list of the client's addresses
+	_, err = database.Exec("CREATE TABLE IF NOT EXISTS clients (uuid TEXT PRIMARY KEY, hostname TEXT UNIQUE, IP TEXT, tenant TEXT NOT NULL DEFAULT 'default')")
+	if err != nil {
+		log.Fatalf("can't create the table, error: %s", err.Error())
+	}
+
+	// Clients registered before tenants were added belong to the default tenant
+	addColumnIfMissing("clients", "tenant", "TEXT NOT NULL DEFAULT 'default'")
+
+	// One row per certificate issued, used to keep inside the Let's Encrypt
+	// rate limits. issued_at is a Unix timestamp.
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS issuances (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT,
+		fqdn TEXT NOT NULL,
+		registered_domain TEXT NOT NULL,
+		issued_at INTEGER NOT NULL)`)
+	if err != nil {
+		log.Fatalf("can't create the issuances table, error: %s", err.Error())
+	}
+	_, err = database.Exec("CREATE INDEX IF NOT EXISTS issuances_domain ON issuances (registered_domain, issued_at)")
+	if err != nil {
+		log.Fatalf("can't create the issuances index, error: %s", err.Error())
+	}
+	// The ACME account URI the certificate was ordered with
+	addColumnIfMissing("issuances", "account", "TEXT NOT NULL DEFAULT ''")
+	// and the name of the CA that issued it
+	addColumnIfMissing("issuances", "ca", "TEXT NOT NULL DEFAULT ''")
+	// 1 if it came from a staging environment, these are counted apart
+	// from the real ones
+	addColumnIfMissing("issuances", "staging", "INTEGER NOT NULL DEFAULT 0")
+	// 1 while the certificate is being ordered. The row is booked before
+	// the order so the budget can't be overrun and removed if it fails.
+	addColumnIfMissing("issuances", "pending", "INTEGER NOT NULL DEFAULT 0")
+	// Nothing is being ordered at start up, anything still pending is left
+	// over from a crash
+	if _, err := database.Exec("DELETE FROM issuances WHERE pending = 1"); err != nil {
+		log.Fatalf("can't clear the pending issuances, error: %s", err.Error())
+	}
+
+	// One row per order placed with a CA whether or not it ended with a
+	// certificate, for the per account limit. ordered_at is a Unix
+	// timestamp.
+	newOrders := !tableExists("orders")
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS orders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		ca TEXT NOT NULL,
+		staging INTEGER NOT NULL,
+		ordered_at INTEGER NOT NULL)`)
+	if err != nil {
+		log.Fatalf("can't create the orders table, error: %s", err.Error())
+	}
+	_, err = database.Exec("CREATE INDEX IF NOT EXISTS orders_account ON orders (account, ordered_at)")
+	if err != nil {
+		log.Fatalf("can't create the orders index, error: %s", err.Error())
+	}
+	// Orders used to be counted from the issuances, carry them over so the
+	// last three hours aren't forgotten
+	if newOrders {
+		_, err = database.Exec("INSERT INTO orders (account, ca, staging, ordered_at) SELECT account, ca, staging, issued_at FROM issuances WHERE account != ''")
+		if err != nil {
+			log.Fatalf("can't copy the orders from the issuances, error: %s", err.Error())
+		}
+	}
+
+	// Certificate requests waiting for rate limit quota to free up. The
+	// certificates are stored PEM encoded once issued.
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS certificate_queue (
+		uuid TEXT PRIMARY KEY,
+		fqdn TEXT NOT NULL,
+		csr BLOB NOT NULL,
+		not_before INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		certificates BLOB,
+		message TEXT)`)
+	if err != nil {
+		log.Fatalf("can't create the certificate queue table, error: %s", err.Error())
+	}
+
+	// Names a client holds on top of its hostname, as full names as they
+	// can be under other domains. kind is alias, serial or domain.
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS client_names (
+		name TEXT PRIMARY KEY,
+		uuid TEXT NOT NULL,
+		kind TEXT NOT NULL)`)
+	if err != nil {
+		log.Fatalf("can't create the client names table, error: %s", err.Error())
+	}
+
+	// Every certificate issued and when it should be renewed. next_check
+	// is when to ask the CA's renewal information again, ari_id is empty
+	// if the CA doesn't have it. replaced is set once the client has a
+	// newer certificate.
+	_, err = database.Exec(`CREATE TABLE IF NOT EXISTS certificates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid TEXT NOT NULL,
+		fqdn TEXT NOT NULL,
+		ca TEXT NOT NULL,
+		serial TEXT NOT NULL,
+		ari_id TEXT NOT NULL,
+		not_before INTEGER NOT NULL,
+		not_after INTEGER NOT NULL,
+		window_start INTEGER NOT NULL,
+		window_end INTEGER NOT NULL,
+		renew_at INTEGER NOT NULL,
+		explanation_url TEXT,
+		next_check INTEGER NOT NULL,
+		replaced INTEGER NOT NULL DEFAULT 0)`)
+	if err != nil {
+		log.Fatalf("can't create the certificates table, error: %s", err.Error())
+	}
+	// The ACME profile the certificate was ordered with, empty for the
+	// CA's default
+	addColumnIfMissing("certificates", "profile", "TEXT NOT NULL DEFAULT ''")
+
+	// Tables created before hostname was marked as unique need the index adding
+	_, err = database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS clients_hostname ON clients (hostname)")
+	if err != nil {
+		log.Fatalf("can't create the hostname index, error: %s", err.Error())
+	}
+}
+
+// Brings tables created by older versions of the server up to date
+func addColumnIfMissing(table string, column string, definition string) {
+	rows, err := database.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Fatalf("can't read the structure of the %s table, error: %s", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			log.Fatalf("can't read the structure of the %s table, error: %s", table, err)
+		}
+		if name == column {
+			return
+		}
+	}
+
+	log.Printf("Adding the %s column to the %s table", column, table)
+	_, err = database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		log.Fatalf("can't add the %s column to the %s table, error: %s", column, table, err)
+	}
+}
+
+func tableExists(table string) bool {
+	var name string
+	err := database.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Fatalf("can't check for the %s table, error: %s", table, err)
+	}
+	return err == nil
+}
+
+// The DSN has _txlock=immediate so the transaction takes the write lock
+// as it begins. A count and the insert that depends on it can't then be
+// split by another request, even from another server sharing the file.
+func withTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var errClientExists = errors.New("The client with provided UUID is already registered")
+var errHostnamesExhausted = errors.New("Could not find an unused hostname, the hostname namespace may be exhausted")
+var errQuotaExceeded = errors.New("The maximum number of clients has been registered")
+
+// The uuid is the primary key so a clash on it comes back as
+// ErrConstraintPrimaryKey, a clash on the hostname as ErrConstraintUnique
+func constraintCode(err error) sqlite3.ErrNoExtended {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.ExtendedCode
+	}
+	return 0
+}
+
+var errHostnameTaken = errors.New("The hostname is already in use")
+
+// The insert is the only check for uniqueness, either the row goes in or
+// the database rejects it, so two servers sharing the same database can't
+// hand out the same hostname or register the same client twice.
+//
+// The tenant's quota is checked in the same statement so it can't be
+// overrun by clients registering at the same time. So is the list of
+// extra names so a hostname can't be handed out if it is someone's alias.
+func insertClient(t *tenant, uuid string, hostname string, ip string) error {
+	log.Debug("Doing the insert")
+	res, err := database.Exec(`INSERT INTO clients (uuid, hostname, IP, tenant)
+		SELECT ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM client_names WHERE name = ?)
+		AND (? = 0 OR (SELECT COUNT(*) FROM clients WHERE tenant = ?) < ?)`,
+		uuid, hostname, ip, t.Name, t.fqdn(hostname), t.MaxClients, t.Name, t.MaxClients)
+	switch {
+	case err == nil:
+		if count, _ := res.RowsAffected(); count == 0 {
+			// Nothing went in, work out which of the conditions stopped it
+			if clientNameExists(t.fqdn(hostname)) {
+				return errHostnameTaken
+			}
+			return errQuotaExceeded
+		}
+		log.Debug("Hostname is unique")
+		return nil
+	case constraintCode(err) == sqlite3.ErrConstraintPrimaryKey:
+		return errClientExists
+	case constraintCode(err) == sqlite3.ErrConstraintUnique:
+		return errHostnameTaken
+	}
+	return err
+}
+
+func clientNameExists(name string) bool {
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM client_names WHERE name = ?", name).Scan(&count); err != nil {
+		log.Printf("Could not look up the name %s, error: %s", name, err)
+		return false
+	}
+	return count > 0
+}
+
+// As with insertClient, the insert is the uniqueness check. The label is
+// checked against everyone else's hostnames in the same statement.
+func insertClientName(uuid string, kind string, label string, name string) error {
+	log.Debugf("Adding the %s name %s", kind, name)
+	res, err := database.Exec(`INSERT INTO client_names (name, uuid, kind)
+		SELECT ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM clients WHERE hostname = ? AND uuid != ?)`,
+		name, uuid, kind, label, uuid)
+	if constraintCode(err) == sqlite3.ErrConstraintPrimaryKey {
+		return errHostnameTaken
+	}
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return errHostnameTaken
+	}
+	return nil
+}
+
+// The addresses are stored comma separated as they are at registration
+func updateClientIPs(uuid string, ips []string) error {
+	_, err := database.Exec("UPDATE clients SET IP = ? WHERE uuid = ?", strings.Join(ips, ","), uuid)
+	return err
+}
+
+func getClientNames(uuid string) ([]string, error) {
+	rows, err := database.Query("SELECT name FROM client_names WHERE uuid = ? ORDER BY kind, name", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Removes the client and its extra names, for a registration that
+// couldn't be finished
+func deleteClient(uuid string) error {
+	return withTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM client_names WHERE uuid = ?", uuid); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM clients WHERE uuid = ?", uuid)
+		return err
+	})
+}
+
+// Gives up after Cfg.HostnameAttempts clashes.
+func allocateHostname(t *tenant, req hostnameRequest, ip string) (string, error) {
+	return allocateHostnameWith(t, t.generator, req, ip)
+}
+
+func allocateHostnameWith(t *tenant, generator HostnameGenerator, req hostnameRequest, ip string) (string, error) {
+	for attempt := 1; attempt <= Cfg.HostnameAttempts; attempt++ {
+		hostname, err := generator.Generate(t, req, attempt)
+		// A conflict rather than a bad name
+		if err == errHostnameTaken {
+			return "", err
+		}
+		if err != nil {
+			return "", hostnameError{err}
+		}
+		log.Printf("Hostname generated: %s", hostname)
+
+		if err := validateHostname(hostname, t.Domain); err != nil {
+			return "", hostnameError{err}
+		}
+		// Treated as taken so the generator has another go
+		if isServerLabel(hostname) {
+			log.Debugf("Hostname is the server's, going around again, attempt %d of %d", attempt, Cfg.HostnameAttempts)
+			continue
+		}
+
+		err = insertClient(t, req.ClientID, hostname, ip)
+		if err == errHostnameTaken {
+			log.Debugf("Hostname already exists, going around again, attempt %d of %d", attempt, Cfg.HostnameAttempts)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return hostname, nil
+	}
+	log.Printf("Gave up generating a hostname after %d attempts", Cfg.HostnameAttempts)
+	return "", errHostnamesExhausted
+}
+
+// Both *sql.DB and *sql.Tx, so the counts can be done inside the
+// transaction that books against them
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// A certificate counts against every registered domain it has a name
+// in so there is a row for each. For certificates ordered without
+// booking them first, the server's own at start up.
+func recordIssuance(uuid string, fqdn string, names []string, ca *certificateAuthority) {
+	now := time.Now().Unix()
+	for _, domain := range registeredDomains(names) {
+		_, err := database.Exec("INSERT INTO issuances (uuid, fqdn, registered_domain, account, ca, staging, issued_at) VALUES (?,?,?,?,?,?,?)",
+			uuid, fqdn, domain, ca.accountURI(), ca.Name, Cfg.ACME.Staging, now)
+		if err != nil {
+			log.Printf("Could not record the issuance for %s, error: %s", fqdn, err)
+		}
+	}
+}
+
+// Books a pending row against each registered domain, returns their IDs
+func insertPendingIssuances(tx *sql.Tx, uuid string, fqdn string, domains []string) ([]int64, error) {
+	now := time.Now().Unix()
+	var ids []int64
+	for _, domain := range domains {
+		result, err := tx.Exec("INSERT INTO issuances (uuid, fqdn, registered_domain, staging, issued_at, pending) VALUES (?,?,?,?,?,1)",
+			uuid, fqdn, domain, Cfg.ACME.Staging, now)
+		if err != nil {
+			return nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// The certificate was issued, the pending rows become real ones
+func confirmIssuances(ids []int64, ca *certificateAuthority) error {
+	for _, id := range ids {
+		_, err := database.Exec("UPDATE issuances SET pending = 0, account = ?, ca = ?, issued_at = ? WHERE id = ?",
+			ca.accountURI(), ca.Name, time.Now().Unix(), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// No certificate came of it so it doesn't count
+func deletePendingIssuances(ids []int64) error {
+	for _, id := range ids {
+		if _, err := database.Exec("DELETE FROM issuances WHERE id = ? AND pending = 1", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertOrder(tx *sql.Tx, ca *certificateAuthority, account string) error {
+	_, err := tx.Exec("INSERT INTO orders (account, ca, staging, ordered_at) VALUES (?,?,?,?)",
+		account, ca.Name, Cfg.ACME.Staging, time.Now().Unix())
+	return err
+}
+
+// Number of certificates issued or being ordered for the registered
+// domain since the given time and when the oldest of them was booked
+func countIssuances(domain string, since time.Time) (int, time.Time, error) {
+	return countIssuancesIn(database, domain, since)
+}
+
+func countIssuancesIn(db queryRower, domain string, since time.Time) (int, time.Time, error) {
+	return countSince(db, "SELECT COUNT(*), MIN(issued_at) FROM issuances WHERE registered_domain = ? AND staging = ? AND issued_at >= ?", domain, since)
+}
+
+// Number of orders placed with the ACME account since the given time,
+// failed ones included, and when the oldest was placed
+func countAccountOrders(account string, since time.Time) (int, time.Time, error) {
+	return countAccountOrdersIn(database, account, since)
+}
+
+func countAccountOrdersIn(db queryRower, account string, since time.Time) (int, time.Time, error) {
+	return countSince(db, "SELECT COUNT(*), MIN(ordered_at) FROM orders WHERE account = ? AND staging = ? AND ordered_at >= ?", account, since)
+}
+
+func countSince(db queryRower, query string, value string, since time.Time) (int, time.Time, error) {
+	var count int
+	var oldest sql.NullInt64
+	row := db.QueryRow(query, value, Cfg.ACME.Staging, since.Unix())
+	if err := row.Scan(&count, &oldest); err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(oldest.Int64, 0), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/digininja/ots-cert-demo/server/config"
+	"sync"
+	"testing"
+)
+
+func testTenant(name string, maxClients int) *tenant {
+	return &tenant{Tenant: config.Tenant{Name: name, Domain: name + ".example.com", MaxClients: maxClients}}
+}
+
+func TestInsertClient(t *testing.T) {
+	testDatabase(t)
+	full := testTenant("full", 2)
+	open := testTenant("open", 0)
+
+	tests := []struct {
+		name     string
+		tenant   *tenant
+		uuid     string
+		hostname string
+		want     error
+	}{
+		{"first", full, "1", "alpha", nil},
+		{"duplicate hostname", full, "2", "alpha", errHostnameTaken},
+		{"duplicate UUID", full, "1", "beta", errClientExists},
+		{"second", full, "2", "beta", nil},
+		{"over the quota", full, "3", "gamma", errQuotaExceeded},
+		{"no quota", open, "3", "gamma", nil},
+		{"no quota again", open, "4", "delta", nil},
+	}
+	for _, test := range tests {
+		if err := insertClient(test.tenant, test.uuid, test.hostname, "192.0.2.1"); err != test.want {
+			t.Errorf("%s: insertClient = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// Someone's extra name can't be handed out as a hostname
+	if err := insertClientName("4", "alias", "epsilon", open.fqdn("epsilon")); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertClient(open, "5", "epsilon", "192.0.2.1"); err != errHostnameTaken {
+		t.Errorf("insertClient over an alias = %v, want %v", err, errHostnameTaken)
+	}
+}
+
+// Gives host-1, host-2 and so on for each attempt, so clients asking at
+// the same time all want the same names
+type attemptGenerator struct{}
+
+func (attemptGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	return fmt.Sprintf("host-%d", attempt), nil
+}
+
+// Always the same name
+type fixedGenerator string
+
+func (g fixedGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	return string(g), nil
+}
+
+func TestAllocateHostnameExhausted(t *testing.T) {
+	testDatabase(t)
+	Cfg.HostnameAttempts = 3
+	ten := testTenant("default", 0)
+
+	tests := []struct {
+		name      string
+		generator HostnameGenerator
+		uuid      string
+		want      string
+		wantErr   error
+	}{
+		{"first", fixedGenerator("kitchen"), "1", "kitchen", nil},
+		{"every attempt taken", fixedGenerator("kitchen"), "2", "", errHostnamesExhausted},
+		{"taken then free", attemptGenerator{}, "2", "host-1", nil},
+		{"next free", attemptGenerator{}, "3", "host-2", nil},
+		{"last attempt", attemptGenerator{}, "4", "host-3", nil},
+		{"all attempts taken", attemptGenerator{}, "5", "", errHostnamesExhausted},
+		{"same client again", fixedGenerator("pantry"), "1", "", errClientExists},
+	}
+	for _, test := range tests {
+		hostname, err := allocateHostnameWith(ten, test.generator, hostnameRequest{ClientID: test.uuid}, "192.0.2.1")
+		if err != test.wantErr || hostname != test.want {
+			t.Errorf("%s: allocateHostnameWith = %q, %v, want %q, %v", test.name, hostname, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestAllocateHostnameConcurrent(t *testing.T) {
+	testDatabase(t)
+	const clients = 20
+	Cfg.HostnameAttempts = clients
+	ten := testTenant("default", 0)
+
+	var wg sync.WaitGroup
+	hostnames := make([]string, clients)
+	errs := make([]error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hostnames[i], errs[i] = allocateHostnameWith(ten, attemptGenerator{}, hostnameRequest{ClientID: fmt.Sprint(i)}, "192.0.2.1")
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]int{}
+	for i := 0; i < clients; i++ {
+		if errs[i] != nil {
+			t.Errorf("client %d: %s", i, errs[i])
+			continue
+		}
+		if other, ok := seen[hostnames[i]]; ok {
+			t.Errorf("clients %d and %d were both given %s", other, i, hostnames[i])
+		}
+		seen[hostnames[i]] = i
+	}
+
+	var count int
+	if err := database.QueryRow("SELECT COUNT(DISTINCT hostname) FROM clients").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != clients {
+		t.Errorf("%d distinct hostnames stored, want %d", count, clients)
+	}
+}
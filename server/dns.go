@@ -14,21 +14,30 @@ https://api.cloudflare.com/#dns-records-for-a-zone-update-dns-record
 */
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/cloudflare/cloudflare-go"
+	"net"
+	"strings"
+	"time"
 )
 import log "github.com/sirupsen/logrus"
 
 func DeleteDNSRecord(entryType string, name string) error {
 	log.Debugf(fmt.Sprintf("Delete is fetching a %s record with the name %s\n", entryType, name))
 
+	zone, err := zoneFor(name)
+	if err != nil {
+		return err
+	}
+
 	// record is used as a filter to say what to bring back, here it is set
 	// to the entry type and name that is needed
 	record := cloudflare.DNSRecord{Type: entryType, Name: name}
 
 	// do the search
-	recs, err := api.DNSRecords(zoneID, record)
+	recs, err := zone.api.DNSRecords(zone.id, record)
 	if err != nil {
 		log.Debug("The record wasn't found, nothing to delete")
 		return nil
@@ -45,7 +54,7 @@ func DeleteDNSRecord(entryType string, name string) error {
 
 		recordID := r.ID
 
-		err = api.DeleteDNSRecord(zoneID, recordID)
+		err = zone.api.DeleteDNSRecord(zone.id, recordID)
 		if err != nil {
 			log.Debugf("Something went wrong with the delete: %s", err)
 			return errors.New(fmt.Sprintf("Something went wrong with the delete: %s", err.Error()))
@@ -57,12 +66,17 @@ func DeleteDNSRecord(entryType string, name string) error {
 func CreateOrUpdateDNSRecord(entryType string, name string, content string) error {
 	log.Debugf("Create or update DNS record, %s containing %s of type %s", name, content, entryType)
 
+	zone, err := zoneFor(name)
+	if err != nil {
+		return err
+	}
+
 	// record is used as a filter to say what to bring back, here it is set
 	// to the entry type and name that is needed
 	record := cloudflare.DNSRecord{Type: entryType, Name: name}
 
 	// do the search
-	recs, err := api.DNSRecords(zoneID, record)
+	recs, err := zone.api.DNSRecords(zone.id, record)
 	if err != nil {
 		log.Debug("Searching for existing record failed")
 		return errors.New("Searching for existing record failed")
@@ -84,7 +98,7 @@ func CreateOrUpdateDNSRecord(entryType string, name string, content string) erro
 			record := cloudflare.DNSRecord{}
 			record.Content = content
 
-			err = api.UpdateDNSRecord(zoneID, responseID, record)
+			err = zone.api.UpdateDNSRecord(zone.id, responseID, record)
 			if err != nil {
 				log.Debugf("Failed to update the DNS record, error: %s", err)
 				return errors.New("Failed to update the DNS record")
@@ -99,7 +113,7 @@ func CreateOrUpdateDNSRecord(entryType string, name string, content string) erro
 		record.Name = name
 		record.Content = content
 
-		_, err := api.CreateDNSRecord(zoneID, record)
+		_, err := zone.api.CreateDNSRecord(zone.id, record)
 		if err != nil {
 			log.Debugf("Failed to add the DNS record, error: %s", err)
 			return errors.New("Failed to add the DNS record")
@@ -108,10 +122,135 @@ func CreateOrUpdateDNSRecord(entryType string, name string, content string) erro
 	return nil
 }
 
+// Adds the record unless one with the same content is already there,
+// any others with the name are left alone
+func AddDNSRecord(entryType string, name string, content string) error {
+	log.Debugf("Adding %s record for %s with %s", entryType, name, content)
+
+	zone, err := zoneFor(name)
+	if err != nil {
+		return err
+	}
+
+	recs, err := zone.api.DNSRecords(zone.id, cloudflare.DNSRecord{Type: entryType, Name: name, Content: content})
+	if err != nil {
+		log.Debug("Searching for existing records failed")
+		return errors.New("Searching for existing records failed")
+	}
+	for _, r := range recs {
+		if r.Content == content {
+			log.Debugf("Record already exists: %s", content)
+			return nil
+		}
+	}
+
+	record := cloudflare.DNSRecord{Type: entryType, Name: name, Content: content}
+	if _, err := zone.api.CreateDNSRecord(zone.id, record); err != nil {
+		log.Debugf("Failed to add the DNS record, error: %s", err)
+		return errors.New("Failed to add the DNS record")
+	}
+	return nil
+}
+
+// Removes the records of the type for the name with the content, the
+// other way round to AddDNSRecord
+func DeleteDNSRecordContent(entryType string, name string, content string) error {
+	log.Debugf("Deleting %s record for %s with %s", entryType, name, content)
+
+	zone, err := zoneFor(name)
+	if err != nil {
+		return err
+	}
+
+	recs, err := zone.api.DNSRecords(zone.id, cloudflare.DNSRecord{Type: entryType, Name: name, Content: content})
+	if err != nil {
+		log.Debug("Searching for existing records failed")
+		return errors.New("Searching for existing records failed")
+	}
+	for _, r := range recs {
+		if r.Content != content {
+			continue
+		}
+		if err := zone.api.DeleteDNSRecord(zone.id, r.ID); err != nil {
+			log.Debugf("Something went wrong with the delete: %s", err)
+			return errors.New(fmt.Sprintf("Something went wrong with the delete: %s", err.Error()))
+		}
+	}
+	return nil
+}
+
+// Makes the records of the given type for the name match the list of
+// contents, adding any which are missing and removing any extra
+func SetDNSRecords(entryType string, name string, contents []string) error {
+	log.Debugf("Setting %s records for %s to %s", entryType, name, strings.Join(contents, ", "))
+
+	zone, err := zoneFor(name)
+	if err != nil {
+		return err
+	}
+
+	recs, err := zone.api.DNSRecords(zone.id, cloudflare.DNSRecord{Type: entryType, Name: name})
+	if err != nil {
+		log.Debug("Searching for existing records failed")
+		return errors.New("Searching for existing records failed")
+	}
+
+	wanted := map[string]bool{}
+	for _, content := range contents {
+		wanted[content] = true
+	}
+
+	for _, r := range recs {
+		if wanted[r.Content] {
+			log.Debugf("Record already exists: %s", r.Content)
+			delete(wanted, r.Content)
+			continue
+		}
+		log.Debugf(fmt.Sprintf("Record to delete - %s: %s (%s)\n", r.Name, r.Content, r.ID))
+		if err := zone.api.DeleteDNSRecord(zone.id, r.ID); err != nil {
+			log.Debugf("Something went wrong with the delete: %s", err)
+			return errors.New(fmt.Sprintf("Something went wrong with the delete: %s", err.Error()))
+		}
+	}
+
+	for content := range wanted {
+		log.Debugf("Creating %s record for %s with %s", entryType, name, content)
+		record := cloudflare.DNSRecord{Type: entryType, Name: name, Content: content}
+		if _, err := zone.api.CreateDNSRecord(zone.id, record); err != nil {
+			log.Debugf("Failed to add the DNS record, error: %s", err)
+			return errors.New("Failed to add the DNS record")
+		}
+	}
+	return nil
+}
+
+// Publishes A records for the IPv4 addresses and AAAA records for the
+// IPv6 ones. Record types with no addresses are removed.
+func SetAddressRecords(name string, ips []string) error {
+	var v4s, v6s []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			log.Debugf("Skipping invalid IP address: %s", ip)
+			continue
+		}
+		if parsed.To4() != nil {
+			v4s = append(v4s, ip)
+		} else {
+			v6s = append(v6s, ip)
+		}
+	}
+
+	if err := SetDNSRecords("A", name, v4s); err != nil {
+		return err
+	}
+	return SetDNSRecords("AAAA", name, v6s)
+}
+
 func getUserDetails() {
 	log.Debug("Getting user details")
 	// Fetch user details on the account
-	u, err := api.UserDetails()
+	u, err := zones[Cfg.Domain].api.UserDetails()
 	if err != nil {
 		log.Fatalf("Error getting user details, error: %s", err)
 	}
@@ -119,27 +258,35 @@ func getUserDetails() {
 	log.Debugf("User details: %u", u)
 }
 
-func CheckRecord(recordType string, name string) bool {
-	// Fetch all records for a zone
-	log.Debugf("Looking for the record %s of type %s", name, recordType)
-
-	record := cloudflare.DNSRecord{
-		Type: recordType,
-		Name: name,
+// Looks the name up through the public resolver, following any CNAME as
+// the CA will, and says whether the value is there yet. Asking the
+// Cloudflare API would only say the record exists, not that it has the
+// value or can be seen.
+func CheckTXTRecord(ctx context.Context, name string, value string) bool {
+	log.Debugf("Looking for %s in the TXT records of %s", value, name)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, Cfg.ACME.ChallengeResolver)
+		},
 	}
-	// Can filter like this when creating
-	// record := cloudflare.DNSRecord{Type: "TXT"}
-	// or
-	// record.Type = "TXT
-
-	recs, err := api.DNSRecords(zoneID, record)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	values, err := resolver.LookupTXT(ctx, name)
 	if err != nil {
 		log.Debugf("There was an error: %s", err.Error())
 		return false
 	}
-	log.Debugf("Found %d record(s)", len(recs))
+	log.Debugf("Found %d record(s)", len(values))
 
-	return len(recs) > 0
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func DumpDNSEntries() {
@@ -152,34 +299,80 @@ func DumpDNSEntries() {
 	// or
 	// record.Type = "TXT
 
-	recs, err := api.DNSRecords(zoneID, record)
-	if err != nil {
-		log.Debugf("There was an error: %s", err.Error())
-		return
-	}
+	for domain, zone := range zones {
+		log.Debugf("Records for %s", domain)
+		recs, err := zone.api.DNSRecords(zone.id, record)
+		if err != nil {
+			log.Debugf("There was an error: %s", err.Error())
+			continue
+		}
 
-	for _, r := range recs {
-		log.Debugf("%s: %s %s (%s)\n", r.Name, r.Type, r.Content, r.ID)
+		for _, r := range recs {
+			log.Debugf("%s: %s %s (%s)\n", r.Name, r.Type, r.Content, r.ID)
+		}
 	}
 }
 
-var zoneID string
-var api *cloudflare.API
+// Each tenant's domain has its own zone which may be in its own account
+type dnsZone struct {
+	api *cloudflare.API
+	id  string
+}
+
+var zones = map[string]*dnsZone{}
+
+// Finds the zone a record belongs in by matching the end of the name
+// against the tenant domains, the longest match wins in case one domain
+// is a subdomain of another
+func zoneFor(name string) (*dnsZone, error) {
+	var best string
+	for domain := range zones {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > len(best) {
+			best = domain
+		}
+	}
+	if best == "" {
+		return nil, errors.New(fmt.Sprintf("No zone configured for the name: %s", name))
+	}
+	return zones[best], nil
+}
 
 func InitCloudflare() {
-	var err error
 	log.Debug("Init Cloudflare DNS module")
 
+	if Cfg.ChallengeZone.Domain != "" {
+		creds := Cfg.ChallengeZone.CloudflareCreds
+		zones[Cfg.ChallengeZone.Domain] = newZone(Cfg.ChallengeZone.Domain, creds.API_Key, creds.API_Email)
+	}
+
+	for _, t := range tenants {
+		// With a challenge zone the main zones' credentials can be left
+		// out, the address records are then up to the operator
+		if Cfg.ChallengeZone.Domain != "" && t.CloudflareCreds.API_Key == "" {
+			log.Printf("No Cloudflare credentials for the tenant %s, address records can't be published so registrations will be refused", t.Name)
+			continue
+		}
+		// Extra domains use the tenant's account
+		for _, domain := range append([]string{t.Domain}, t.ExtraNames.ExtraDomains...) {
+			if _, done := zones[domain]; done {
+				continue
+			}
+			zones[domain] = newZone(domain, t.CloudflareCreds.API_Key, t.CloudflareCreds.API_Email)
+		}
+	}
+}
+
+func newZone(domain string, key string, email string) *dnsZone {
 	// Construct a new API object
-	api, err = cloudflare.New(Cfg.CloudflareCreds.API_Key, Cfg.CloudflareCreds.API_Email)
+	api, err := cloudflare.New(key, email)
 	if err != nil {
 		log.Fatalf("Error creating Cloudflare object, error: %s", err)
 	}
 
 	// Fetch the zone ID
-	id, err := api.ZoneIDByName(Cfg.Domain)
+	id, err := api.ZoneIDByName(domain)
 	if err != nil {
-		log.Fatalf("Error fetching zone ID, error: %s", err)
+		log.Fatalf("Error fetching zone ID for %s, error: %s", domain, err)
 	}
 
 	// Fetch zone details
@@ -187,8 +380,9 @@ func InitCloudflare() {
 	if err != nil {
 		log.Fatal("Error fetching zone details, error: %s", err)
 	}
-	zoneID = zone.ID
 
 	// Print zone details
-	log.Debugf("The zone ID is %s\n", zone.ID)
+	log.Debugf("The zone ID for %s is %s\n", domain, zone.ID)
+
+	return &dnsZone{api: api, id: zone.ID}
 }
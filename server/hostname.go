@@ -0,0 +1,300 @@
+package main
+
+/*
+Hostname generation. The strategy is picked per tenant in the config
+file with the hostnames.generator option:
+
+names  - Docker's namesgenerator, e.g. nifty-babbage
+serial - a hash of the device serial number, e.g. acme-k3j9x2mq4d
+random - the vendor prefix plus a short random base32 string
+model  - the product model plus a short random base32 string
+vanity - the name the client asked for, nothing else is accepted
+
+Whatever is generated has to be a valid DNS label as it gets put in
+front of the domain to make the FQDN.
+
+Hostnames are unique across all tenants, not just within a domain. The
+server's own hostname is reserved in every tenant, see serverLabels.
+
+If hostnames.allowRequested is set, a hostname sent by the client is
+tried first with the other generators and used as long as it passes
+the policy in checkHostnamePolicy and isn't already taken. If it
+isn't used, the generator picks one instead and the client is told
+why.
+*/
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/server/config"
+	"github.com/docker/docker/pkg/namesgenerator"
+	"regexp"
+	"strings"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// Everything the generators might want to know about the client
+type hostnameRequest struct {
+	ClientID  string
+	Serial    string
+	Model     string
+	Requested string
+}
+
+type HostnameGenerator interface {
+	// attempt starts at 1 and goes up each time the previous name
+	// was already taken, generators that always produce the same
+	// name for a client use it to make the name unique
+	Generate(t *tenant, req hostnameRequest, attempt int) (string, error)
+}
+
+// Returned when a usable hostname can't be generated for the client, the
+// message is safe to pass back to it
+type hostnameError struct {
+	error
+}
+
+var lowerBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func newHostnameGenerator(h config.Hostnames) (HostnameGenerator, error) {
+	// A SHA256 hash is 52 characters once base32 encoded
+	if h.RandomLength < 1 || h.RandomLength > 52 {
+		return nil, errors.New(fmt.Sprintf("randomLength must be between 1 and 52, got: %d", h.RandomLength))
+	}
+
+	switch strings.ToLower(h.Generator) {
+	case "", "names":
+		return namesGenerator{}, nil
+	case "serial":
+		return serialGenerator{prefix: h.Prefix, salt: h.Salt, length: h.RandomLength}, nil
+	case "random":
+		if h.Prefix == "" {
+			return nil, errors.New("The random generator needs a prefix")
+		}
+		return randomGenerator{prefix: h.Prefix, length: h.RandomLength}, nil
+	case "model":
+		return modelGenerator{fallback: h.Prefix, length: h.RandomLength}, nil
+	case "vanity":
+		return vanityGenerator{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown hostname generator: %s", h.Generator))
+}
+
+// The server has no serial, model or requested name so generators that
+// need one can't name it. It gets its name from the random generator if
+// that is in use, otherwise from Docker's names.
+func serverHostnameGenerator(t *tenant) HostnameGenerator {
+	if g, ok := t.generator.(randomGenerator); ok {
+		return g
+	}
+	return namesGenerator{}
+}
+
+// Rules for a single label from RFC 1035 and RFC 1123, letters, digits
+// and hyphens, can't start or end with a hyphen, 63 characters max.
+var dnsLabelRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func validateHostname(hostname string, domain string) error {
+	if len(hostname) == 0 {
+		return errors.New("The hostname is empty")
+	}
+	if len(hostname) > 63 {
+		return errors.New(fmt.Sprintf("The hostname is longer than 63 characters: %s", hostname))
+	}
+	if !dnsLabelRegexp.MatchString(hostname) {
+		return errors.New(fmt.Sprintf("The hostname is not a valid DNS label: %s", hostname))
+	}
+	// The FQDN can't be longer than 253 characters
+	if len(hostname)+1+len(domain) > 253 {
+		return errors.New(fmt.Sprintf("The hostname is too long for the domain: %s", hostname))
+	}
+	return nil
+}
+
+// The labels the server's own names are made from, they are never given
+// to a client. A hostname set in the config isn't in the clients table
+// so without this the database wouldn't stop a client taking it, or
+// using it as an alias or serial name. The server's certificate names,
+// wildcard included, are all made from the one label.
+func serverLabels() []string {
+	if Cfg.Hostname == "" {
+		// A generated one is in the clients table like any other
+		return nil
+	}
+	return []string{strings.ToLower(Cfg.Hostname)}
+}
+
+func isServerLabel(label string) bool {
+	for _, reserved := range serverLabels() {
+		if label == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// The checks for a hostname requested by the client, uniqueness is left
+// to the database when the client is inserted
+func checkHostnamePolicy(t *tenant, hostname string) error {
+	if len(hostname) < t.Hostnames.MinLength {
+		return errors.New(fmt.Sprintf("The hostname is shorter than %d characters", t.Hostnames.MinLength))
+	}
+	if len(hostname) > t.Hostnames.MaxLength {
+		return errors.New(fmt.Sprintf("The hostname is longer than %d characters", t.Hostnames.MaxLength))
+	}
+	if err := validateHostname(hostname, t.Domain); err != nil {
+		return err
+	}
+	if isServerLabel(hostname) {
+		return errors.New(fmt.Sprintf("The hostname is reserved: %s", hostname))
+	}
+	for _, reserved := range t.Hostnames.Reserved {
+		if hostname == strings.ToLower(reserved) {
+			return errors.New(fmt.Sprintf("The hostname is reserved: %s", hostname))
+		}
+	}
+	// Don't echo the word back in case it is something offensive
+	for _, blocked := range t.Hostnames.Blocklist {
+		if strings.Contains(hostname, strings.ToLower(blocked)) {
+			return errors.New("The hostname contains a word which is not allowed")
+		}
+	}
+	return nil
+}
+
+// Tries the hostname the client asked for before falling back to the
+// generator. The reason is empty if the client got the name it wanted or
+// didn't ask for one, otherwise it says why the name was substituted.
+func allocateRequestedHostname(t *tenant, req hostnameRequest, ip string) (hostname string, reason string, err error) {
+	_, vanity := t.generator.(vanityGenerator)
+	if req.Requested != "" && t.Hostnames.RequestedAllowed() && !vanity {
+		requested := strings.ToLower(req.Requested)
+		log.Debugf("Client requested the hostname: %s", requested)
+
+		policyErr := checkHostnamePolicy(t, requested)
+		if policyErr == nil {
+			err = insertClient(t, req.ClientID, requested, ip)
+			if err == nil {
+				return requested, "", nil
+			}
+			if err != errHostnameTaken {
+				return "", "", err
+			}
+			policyErr = err
+		}
+		reason = fmt.Sprintf("The requested hostname %s could not be used: %s", req.Requested, policyErr)
+		log.Printf("%s", reason)
+	} else if req.Requested != "" && !vanity {
+		reason = "The server does not accept requested hostnames"
+	}
+
+	hostname, err = allocateHostname(t, req, ip)
+	if err != nil {
+		return "", "", err
+	}
+	return hostname, reason, nil
+}
+
+var notLabelRegexp = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Lower cases the string and swaps anything not allowed in a label for a
+// hyphen, used to clean up input from the client before it goes in a name
+func toLabel(s string) string {
+	s = strings.ToLower(s)
+	s = notLabelRegexp.ReplaceAllString(s, "-")
+	return strings.Trim(s, "-")
+}
+
+func randomString(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Could not read random data, error: %s", err)
+	}
+	return lowerBase32.EncodeToString(b)[:length]
+}
+
+// Adds a number to the end of the name for the second and later attempts
+func withAttempt(name string, attempt int) string {
+	if attempt > 1 {
+		return fmt.Sprintf("%s-%d", name, attempt)
+	}
+	return name
+}
+
+type namesGenerator struct{}
+
+func (g namesGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	// Passing a retry count in adds a random digit on the end which gives
+	// a much larger namespace once the plain names start clashing
+	hostname := namesgenerator.GetRandomName(attempt - 1)
+
+	// underscore not allowed in the hostname so having to swap for a hyphen
+	hostname = strings.Replace(hostname, "_", "-", -1)
+
+	return hostname, nil
+}
+
+type serialGenerator struct {
+	prefix string
+	salt   string
+	length int
+}
+
+func (g serialGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	if req.Serial == "" {
+		return "", errors.New("The serial generator needs the client to send its serial number")
+	}
+	sum := sha256.Sum256([]byte(g.salt + req.Serial))
+	hostname := lowerBase32.EncodeToString(sum[:])[:g.length]
+	if g.prefix != "" {
+		hostname = toLabel(g.prefix) + "-" + hostname
+	}
+	return withAttempt(hostname, attempt), nil
+}
+
+type randomGenerator struct {
+	prefix string
+	length int
+}
+
+func (g randomGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	return toLabel(g.prefix) + "-" + randomString(g.length), nil
+}
+
+type modelGenerator struct {
+	fallback string
+	length   int
+}
+
+func (g modelGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	prefix := toLabel(req.Model)
+	if prefix == "" {
+		prefix = toLabel(g.fallback)
+	}
+	if prefix == "" {
+		return "", errors.New("The model generator needs the client to send its model or a prefix to be configured")
+	}
+	return prefix + "-" + randomString(g.length), nil
+}
+
+type vanityGenerator struct{}
+
+func (g vanityGenerator) Generate(t *tenant, req hostnameRequest, attempt int) (string, error) {
+	if req.Requested == "" {
+		return "", errors.New("The vanity generator needs the client to request a hostname")
+	}
+	// Nothing else to try, the name is someone else's
+	if attempt > 1 {
+		log.Printf("The requested hostname is already taken: %s", req.Requested)
+		return "", errHostnameTaken
+	}
+	hostname := strings.ToLower(req.Requested)
+	if err := checkHostnamePolicy(t, hostname); err != nil {
+		return "", err
+	}
+	return hostname, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/digininja/ots-cert-demo/server/config"
+	"testing"
+)
+
+func TestCheckHostnamePolicy(t *testing.T) {
+	Cfg.Hostname = "OTSServer"
+	defer func() { Cfg.Hostname = "" }()
+
+	ten := &tenant{Tenant: config.Tenant{
+		Domain: "devices.example.com",
+		Hostnames: config.Hostnames{
+			MinLength: 3,
+			MaxLength: 20,
+			Reserved:  []string{"www", "Mail"},
+			Blocklist: []string{"rude"},
+		},
+	}}
+
+	tests := []struct {
+		hostname string
+		ok       bool
+	}{
+		{"kitchen-sensor", true},
+		{"ab", false},
+		{"a-very-long-hostname-indeed", false},
+		{"-leading", false},
+		{"trailing-", false},
+		{"under_score", false},
+		{"www", false},
+		{"mail", false},
+		{"otsserver", false},
+		{"not-rude-at-all", false},
+		{"sensor-42", true},
+	}
+	for _, test := range tests {
+		err := checkHostnamePolicy(ten, test.hostname)
+		if (err == nil) != test.ok {
+			t.Errorf("checkHostnamePolicy(%q) = %v, want ok %t", test.hostname, err, test.ok)
+		}
+	}
+}
+
+func TestServerHostnameGenerator(t *testing.T) {
+	tests := []struct {
+		generator HostnameGenerator
+		want      HostnameGenerator
+	}{
+		{namesGenerator{}, namesGenerator{}},
+		{randomGenerator{prefix: "acme", length: 8}, randomGenerator{prefix: "acme", length: 8}},
+		{serialGenerator{prefix: "acme", length: 8}, namesGenerator{}},
+		{vanityGenerator{}, namesGenerator{}},
+		{modelGenerator{length: 8}, namesGenerator{}},
+	}
+	for _, test := range tests {
+		got := serverHostnameGenerator(&tenant{generator: test.generator})
+		if got != test.want {
+			t.Errorf("serverHostnameGenerator(%T) = %T, want %T", test.generator, got, test.want)
+		}
+	}
+}
+
+func TestVanityHostnameTaken(t *testing.T) {
+	testDatabase(t)
+	Cfg.HostnameAttempts = 3
+	ten := &tenant{Tenant: config.Tenant{
+		Name:      "default",
+		Domain:    "devices.example.com",
+		Hostnames: config.Hostnames{MinLength: 3, MaxLength: 63},
+	}}
+
+	tests := []struct {
+		uuid      string
+		requested string
+		want      string
+		wantErr   error
+	}{
+		{"1", "Kitchen", "kitchen", nil},
+		{"2", "kitchen", "", errHostnameTaken},
+		{"2", "pantry", "pantry", nil},
+	}
+	for _, test := range tests {
+		req := hostnameRequest{ClientID: test.uuid, Requested: test.requested}
+		hostname, err := allocateHostnameWith(ten, vanityGenerator{}, req, "192.0.2.1")
+		if err != test.wantErr || hostname != test.want {
+			t.Errorf("%s asking for %s: got %q, %v, want %q, %v", test.uuid, test.requested, hostname, err, test.want, test.wantErr)
+		}
+	}
+	// A bad name is still the client's fault
+	_, err := allocateHostnameWith(ten, vanityGenerator{}, hostnameRequest{ClientID: "3", Requested: "-bad"}, "192.0.2.1")
+	if _, ok := err.(hostnameError); !ok {
+		t.Errorf("asking for -bad: got %v, want a hostnameError", err)
+	}
+}
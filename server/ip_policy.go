@@ -0,0 +1,57 @@
+package main
+
+/*
+Decides which client IP addresses can be registered. This is here to
+try to stop the system from being abused by creating certificates for
+public facing sites.
+
+Each tenant has an allow and a deny list of CIDRs, the deny list wins
+if an address is in both. An empty allow list lets through anything
+not denied. By default only the RFC 1918 ranges and IPv6 unique local
+addresses are allowed.
+*/
+
+import (
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	"net"
+)
+
+type ipPolicy struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPPolicy(allow []string, deny []string) (*ipPolicy, error) {
+	var policy ipPolicy
+	var err error
+	if policy.allow, err = interop.ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = interop.ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Returns nil if the address is allowed, otherwise the reason it isn't
+func (p *ipPolicy) check(address string) *interop.IPRejection {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return &interop.IPRejection{IP: address, Reason: interop.IPRejectInvalid, Detail: "Not a valid IP address"}
+	}
+	for _, block := range p.deny {
+		if block.Contains(ip) {
+			return &interop.IPRejection{IP: address, Reason: interop.IPRejectDenied, Detail: fmt.Sprintf("In the denied range %s", block)}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, block := range p.allow {
+		if block.Contains(ip) {
+			return nil
+		}
+	}
+	return &interop.IPRejection{IP: address, Reason: interop.IPRejectNotAllowed, Detail: "Not in any of the allowed ranges"}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/digininja/ots-cert-demo/interop"
+	"testing"
+)
+
+func TestIPPolicyCheck(t *testing.T) {
+	policy, err := newIPPolicy([]string{"10.0.0.0/8", "fc00::/7"}, []string{"10.99.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := newIPPolicy(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy  *ipPolicy
+		address string
+		reason  string
+	}{
+		{policy, "10.1.2.3", ""},
+		{policy, "fd00::1", ""},
+		{policy, "10.99.1.1", interop.IPRejectDenied},
+		{policy, "192.168.1.1", interop.IPRejectNotAllowed},
+		{policy, "2001:db8::1", interop.IPRejectNotAllowed},
+		{policy, "not an address", interop.IPRejectInvalid},
+		{open, "203.0.113.1", ""},
+		{open, "192.0.2.1", interop.IPRejectDenied},
+	}
+	for _, test := range tests {
+		rejection := test.policy.check(test.address)
+		reason := ""
+		if rejection != nil {
+			reason = rejection.Reason
+		}
+		if reason != test.reason {
+			t.Errorf("check(%q) rejected with %q, want %q", test.address, reason, test.reason)
+		}
+	}
+}
+
+func TestNewIPPolicyBadCIDR(t *testing.T) {
+	if _, err := newIPPolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("An invalid CIDR was accepted")
+	}
+}
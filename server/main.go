@@ -14,14 +14,13 @@ https://api.cloudflare.com/#dns-records-for-a-zone-update-dns-record
 */
 
 import (
-	"database/sql"
+	"context"
 	"encoding/pem" // needed for debug writing out csr
 	"flag"
 	"fmt"
 	"github.com/digininja/ots-cert-demo/interop"
 	"github.com/digininja/ots-cert-demo/server/config"
 	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"strings"
 	"time"
@@ -29,27 +28,6 @@ import (
 
 import log "github.com/sirupsen/logrus"
 
-var database *sql.DB
-
-func initDatabase() {
-	log.Debug("Setting up the database")
-
-	var err error
-	database, err = sql.Open("sqlite3", "./ots-cert.db")
-	if err != nil {
-		log.Fatalf("can't connect to the database, error: %s", err)
-	}
-
-	log.Debug("Creating the database if required")
-
-	statement, err := database.Prepare("CREATE TABLE IF NOT EXISTS clients (uuid TEXT PRIMARY KEY, hostname TEXT, IP TEXT)")
-	statement.Exec()
-
-	if err != nil {
-		log.Fatalf("can't create the table, error: %s", err.Error())
-	}
-}
-
 var Cfg config.Config
 var CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
@@ -69,6 +47,8 @@ func main() {
 	configFilePtr := CommandLine.String("config", "ots-cert-server.cfg", "Alternative configuration file")
 	debugPtr := CommandLine.String("debugLevel", "", "Debug options, I = Info, D = Full Debug")
 	interfaceNamePtr := CommandLine.String("interface", "", "The name of the interface to use if there are multiple")
+	stagingPtr := CommandLine.Bool("staging", false, "Use the CA's staging environment, for development")
+	writeCAAPtr := CommandLine.Bool("writecaa", false, "Add CAA records for the CAs and accounts in use to the tenant domains then exit")
 	versionPtr := CommandLine.Bool("version", false, "")
 	CommandLine.Usage = Usage
 	CommandLine.Parse(os.Args[1:])
@@ -97,6 +77,10 @@ func main() {
 		log.Fatalf(fmt.Sprintf("Configuration file error: %s", err.Error()))
 	}
 
+	if *stagingPtr {
+		Cfg.ACME.Staging = true
+	}
+
 	log.Debugf("The server will be acting on behalf of the domain: %s", Cfg.Domain)
 
 	if *dumpConfigPtr {
@@ -115,7 +99,15 @@ func main() {
 		interfaceName = *interfaceNamePtr
 		log.Debugf("Forcing the use of the interface: %s", interfaceName)
 	}
-	ip := interop.GetIP(interfaceName)
+	ips, err := interop.SelectIPs(interop.IPPolicy{
+		Interface:      interfaceName,
+		Allow:          Cfg.IPSelection.Allow,
+		Deny:           Cfg.IPSelection.Deny,
+		SkipInterfaces: Cfg.IPSelection.SkipInterfaces,
+	})
+	if err != nil {
+		log.Fatalf("Could not pick an IP address: %s", err)
+	}
 
 	var hostname string
 	var fqdn string
@@ -124,6 +116,8 @@ func main() {
 	// at the end, a new certificate is created
 	certValid := false
 
+	initTenants()
+
 	// Initialise all the Cloudflare stuff here so it can be used to generate a local certificate
 	// if required.
 	InitCloudflare()
@@ -131,25 +125,18 @@ func main() {
 	// Create the database early on so it can be used
 	initDatabase()
 
+	initRateLimits()
+
+	initACME()
+	checkProfiles()
+
+	if *writeCAAPtr {
+		writeCAARecords()
+		os.Exit(0)
+	}
+
 	if Cfg.Hostname == "" {
 		log.Debug("No hostname specified, generating one")
-		for {
-			hostname = generateHostname()
-			log.Printf("Hostname generated: %s", hostname)
-			row := database.QueryRow("select count(*) from clients where hostname=?", hostname)
-			var count int
-			err := row.Scan(&count)
-			if err != nil {
-				log.Fatalf("Error on the scan, error: %s", err)
-			}
-			// log.Printf("the count is %d", count)
-			if count > 0 {
-				log.Debug("Hostname already exists, going around again")
-			} else {
-				log.Debug("Hostname is unique")
-				break
-			}
-		}
 
 		// This isn't needed by the server but prevents a client from coming in and getting the
 		// same hostname.
@@ -157,17 +144,15 @@ func main() {
 		s := uuid.String()
 		log.Debugf("UUID: %s", s)
 
-		log.Debug("Doing the insert")
-		_, err = database.Exec("INSERT INTO clients (uuid, hostname, IP) VALUES (?,?,?)", uuid, hostname, ip)
-
+		hostname, err = allocateHostnameWith(defaultTenant, serverHostnameGenerator(defaultTenant), hostnameRequest{ClientID: s}, strings.Join(ips, ","))
 		if err != nil {
 			log.Fatalf("Could not insert data into the database, error: %s", err)
 		}
 
-		fqdn = fmt.Sprintf("%s.%s", hostname, Cfg.Domain)
+		fqdn = defaultTenant.fqdn(hostname)
 	} else {
 		hostname = Cfg.Hostname
-		fqdn = fmt.Sprintf("%s.%s", hostname, Cfg.Domain)
+		fqdn = defaultTenant.fqdn(hostname)
 
 		_, certExistsErr := os.Stat(Cfg.WebServer.CertFilename)
 		_, keyExistsErr := os.Stat(Cfg.WebServer.KeyFilename)
@@ -228,12 +213,22 @@ func main() {
 		}
 		log.Debug("Generating the CSR")
 
-		csr, err := interop.GenerateCSR(Cfg.WebServer.CSRFilename, fqdn, privateKeyBytes)
+		// The server doesn't get any extra names
+		names := defaultTenant.certificateNames(hostname, nil)
+		logChallengeCNAMEs(names)
+		csr, err := interop.GenerateCSR(Cfg.WebServer.CSRFilename, names, Cfg.CSRSubject, privateKeyBytes)
 		if err != nil {
 			log.Fatalf("Could not generate the CSR: %s", err.Error())
 		}
 
-		certificates, err := GenerateCertificate(csr, fqdn)
+		certificates, ca, err := GenerateCertificate(context.Background(), csr, names, "")
+		if err != nil {
+			log.Fatalf("Could not generate the certificate: %s", err)
+		}
+		recordIssuance("", fqdn, names, ca)
+		if renewal := recordCertificate("", fqdn, ca, "", certificates); renewal != nil {
+			log.Printf("The server's certificate should be renewed at %s", renewal.RenewAt)
+		}
 
 		log.Debug("Certificate generated, writing it to disk")
 
@@ -253,9 +248,19 @@ func main() {
 	}
 	// os.Exit(10)
 
-	log.Printf("Creating DNS record")
-	log.Debugf("Creating A record for %s with IP %s", hostname, ip)
-	CreateOrUpdateDNSRecord("A", fqdn, ip)
+	if defaultTenant.managesAddresses() {
+		log.Printf("Creating DNS records")
+		log.Debugf("Creating address records for %s with IPs %s", hostname, strings.Join(ips, ", "))
+		for _, name := range defaultTenant.certificateNames(hostname, nil) {
+			if err := SetAddressRecords(name, ips); err != nil {
+				log.Fatalf("Could not create the address records for %s, error: %s", name, err)
+			}
+		}
+	} else {
+		log.Printf("No Cloudflare credentials for %s, the address records for %s have to be created by hand", Cfg.Domain, fqdn)
+	}
+
+	runScheduler()
 
 	StartWebServer()
 }
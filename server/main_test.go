@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// A fresh database in a temporary directory, closed when the test ends
+func testDatabase(t *testing.T) {
+	t.Helper()
+	Cfg.Database.Path = filepath.Join(t.TempDir(), "test.db")
+	Cfg.Database.BusyTimeout = 5000
+	Cfg.Database.MaxOpenConns = 5
+	Cfg.Database.MaxIdleConns = 5
+	initDatabase()
+	t.Cleanup(func() {
+		database.Close()
+	})
+
+	var mode string
+	if err := database.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("The database is in %s mode, not WAL", mode)
+	}
+}
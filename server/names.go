@@ -0,0 +1,83 @@
+package main
+
+/*
+Extra names a client can have on its certificate as well as its
+hostname. The server decides what these are, the client only gets to
+ask for an alias:
+
+alias  - a short name the client asks for, under the tenant domain
+serial - a name made from the serial number, e.g. sn-abc123
+domain - the hostname under each of the tenant's extra domains
+
+Each name is held in the client_names table so no two clients can
+have the same one. A name that can't be given is left off and the
+client told why, it doesn't stop the registration.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/interop"
+	"strings"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const (
+	nameKindAlias  = "alias"
+	nameKindSerial = "serial"
+	nameKindDomain = "domain"
+)
+
+func allocateExtraNames(t *tenant, uuid string, hostname string, serial string, alias string) ([]string, []interop.NameRefusal) {
+	var names []string
+	var refused []interop.NameRefusal
+
+	add := func(kind string, label string, name string) {
+		if err := insertClientName(uuid, kind, label, name); err != nil {
+			if err != errHostnameTaken {
+				log.Printf("Could not store the %s name %s, error: %s", kind, name, err)
+				err = errors.New("The name could not be stored")
+			}
+			log.Printf("Not adding the %s name %s: %s", kind, name, err)
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: err.Error()})
+			return
+		}
+		names = append(names, name)
+	}
+
+	if alias != "" {
+		alias = strings.ToLower(alias)
+		name := t.fqdn(alias)
+		if !t.ExtraNames.AllowAlias {
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: "The server does not accept aliases"})
+		} else if err := checkHostnamePolicy(t, alias); err != nil {
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: err.Error()})
+		} else {
+			add(nameKindAlias, alias, name)
+		}
+	}
+
+	if t.ExtraNames.SerialNames && serial != "" {
+		label := t.ExtraNames.SerialPrefix + toLabel(serial)
+		name := t.fqdn(label)
+		if err := validateHostname(label, t.Domain); err != nil {
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: err.Error()})
+		} else if isServerLabel(label) {
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: "The name is reserved"})
+		} else {
+			add(nameKindSerial, label, name)
+		}
+	}
+
+	for _, domain := range t.ExtraNames.ExtraDomains {
+		name := fmt.Sprintf("%s.%s", hostname, domain)
+		if err := validateHostname(hostname, domain); err != nil {
+			refused = append(refused, interop.NameRefusal{Name: name, Reason: err.Error()})
+			continue
+		}
+		add(nameKindDomain, hostname, name)
+	}
+
+	return names, refused
+}
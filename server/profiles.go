@@ -0,0 +1,238 @@
+package main
+
+/*
+Certificate profiles, draft-aaron-acme-profiles. CAs list the profiles
+they offer in the directory meta and the one wanted is named in the new
+order. Let's Encrypt has "classic", "tlsserver" and "shortlived", the
+last giving six day certificates which don't need revocation checking
+as they expire before revocation would matter.
+
+Each tenant can pick a profile with certificateProfile. The acme package
+can't send one so the new order request is signed here, everything after
+that is done by the package as normal. CAs which don't offer the profile
+are skipped when ordering for the tenant.
+*/
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// Anything shorter than this is treated as short lived and renewed
+// earlier in its life
+const shortLivedLifetime = 10 * 24 * time.Hour
+
+type errProfileNotOffered struct {
+	ca      string
+	profile string
+}
+
+func (e errProfileNotOffered) Error() string {
+	return fmt.Sprintf("%s does not offer the certificate profile %s", e.ca, e.profile)
+}
+
+func (ca *certificateAuthority) offersProfile(ctx context.Context, profile string) (bool, error) {
+	directory, err := ca.directory(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, ok := directory.Meta.Profiles[profile]
+	return ok, nil
+}
+
+type orderIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type profileOrderRequest struct {
+	Identifiers []orderIdentifier `json:"identifiers"`
+	Profile     string            `json:"profile"`
+}
+
+type problemDocument struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// Creates the order with the profile and returns it as the acme package
+// would have. The account must already be registered.
+func (ca *certificateAuthority) authorizeOrderWithProfile(ctx context.Context, names []string, profile string) (*acme.Order, error) {
+	offered, err := ca.offersProfile(ctx, profile)
+	if err != nil {
+		return nil, caUnavailableError{errors.New(fmt.Sprintf("Can't read the directory, error: %s", err))}
+	}
+	if !offered {
+		return nil, errProfileNotOffered{ca: ca.Name, profile: profile}
+	}
+
+	key, ok := ca.client.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Only ECDSA account keys can be used with certificate profiles")
+	}
+
+	directory, err := ca.client.Discover(ctx)
+	if err != nil {
+		return nil, acmeError("Can't read the directory", err)
+	}
+
+	order := profileOrderRequest{Profile: profile}
+	for _, name := range names {
+		order.Identifiers = append(order.Identifiers, orderIdentifier{Type: "dns", Value: name})
+	}
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+
+	// A stale nonce gets one more go with a fresh one
+	var resp *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		nonce, err := ca.fetchNonce(ctx, directory.NonceURL)
+		if err != nil {
+			return nil, acmeError("Can't get a nonce", err)
+		}
+		body, err := signJWS(key, ca.accountURI(), nonce, directory.OrderURL, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("POST", directory.OrderURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err = ca.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, acmeError("Can't create the order", err)
+		}
+		if resp.StatusCode == http.StatusCreated {
+			break
+		}
+
+		acmeErr := responseError(resp)
+		resp.Body.Close()
+		if acmeErr.ProblemType == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			log.Debug("The nonce was rejected, trying again")
+			continue
+		}
+		return nil, acmeError("Can't create the order", acmeErr)
+	}
+	resp.Body.Close()
+
+	orderURL := resp.Header.Get("Location")
+	if orderURL == "" {
+		return nil, errors.New("The CA did not return the order URL")
+	}
+	log.Debugf("Created the order %s with the profile %s", orderURL, profile)
+
+	created, err := ca.client.GetOrder(ctx, orderURL)
+	if err != nil {
+		return nil, acmeError("Can't fetch the order", err)
+	}
+	return created, nil
+}
+
+func (ca *certificateAuthority) fetchNonce(ctx context.Context, nonceURL string) (string, error) {
+	req, err := http.NewRequest("HEAD", nonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ca.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("No nonce returned")
+	}
+	return nonce, nil
+}
+
+// Turns a problem document into the error the acme package would have
+// returned so the rate limit and failover checks work on it
+func responseError(resp *http.Response) *acme.Error {
+	acmeErr := &acme.Error{StatusCode: resp.StatusCode, Header: resp.Header}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var problem problemDocument
+	if err := json.Unmarshal(body, &problem); err == nil {
+		acmeErr.ProblemType = problem.Type
+		acmeErr.Detail = problem.Detail
+	} else {
+		acmeErr.Detail = string(body)
+	}
+	return acmeErr
+}
+
+// Flattened JWS signed with ES256, the account key is P-256
+func signJWS(key *ecdsa.PrivateKey, kid string, nonce string, url string, payload []byte) ([]byte, error) {
+	protected, err := json.Marshal(map[string]string{
+		"alg":   "ES256",
+		"kid":   kid,
+		"nonce": nonce,
+		"url":   url,
+	})
+	if err != nil {
+		return nil, err
+	}
+	protected64 := base64.RawURLEncoding.EncodeToString(protected)
+	payload64 := base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(protected64 + "." + payload64))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// r and s are each padded out to the size of the curve
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+
+	return json.Marshal(map[string]string{
+		"protected": protected64,
+		"payload":   payload64,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// The tenants' profiles have to be offered by at least one of the CAs. A
+// CA that can't be reached is given the benefit of the doubt.
+func checkProfiles() {
+	for _, t := range tenants {
+		if t.CertificateProfile == "" {
+			continue
+		}
+		offered, unknown := false, false
+		for _, ca := range caOrder {
+			ok, err := ca.offersProfile(context.Background(), t.CertificateProfile)
+			if err != nil {
+				log.Printf("Can't check the profiles offered by %s, error: %s", ca.Name, err)
+				unknown = true
+				continue
+			}
+			if ok {
+				offered = true
+			} else {
+				log.Printf("%s does not offer the profile %s, it won't be used for the tenant %s", ca.Name, t.CertificateProfile, t.Name)
+			}
+		}
+		if !offered && !unknown {
+			log.Fatalf("None of the CAs offer the certificate profile %s used by the tenant %s", t.CertificateProfile, t.Name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestSignJWS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"order", []byte(`{"identifiers":[{"type":"dns","value":"a.example.com"}],"profile":"shortlived"}`)},
+		// POST-as-GET has an empty payload
+		{"post as get", []byte{}},
+	}
+	for _, test := range tests {
+		js, err := signJWS(key, "https://ca.example/acct/1", "nonce-1", "https://ca.example/new-order", test.payload)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		var jws struct {
+			Protected string `json:"protected"`
+			Payload   string `json:"payload"`
+			Signature string `json:"signature"`
+		}
+		if err := json.Unmarshal(js, &jws); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var protected map[string]string
+		if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		want := map[string]string{"alg": "ES256", "kid": "https://ca.example/acct/1", "nonce": "nonce-1", "url": "https://ca.example/new-order"}
+		for k, v := range want {
+			if protected[k] != v {
+				t.Errorf("%s: protected %s = %q, want %q", test.name, k, protected[k], v)
+			}
+		}
+
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if string(payload) != string(test.payload) {
+			t.Errorf("%s: payload = %q, want %q", test.name, payload, test.payload)
+		}
+
+		sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+		if len(sig) != 64 {
+			t.Fatalf("%s: signature is %d bytes, want 64", test.name, len(sig))
+		}
+		hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(&key.PublicKey, hash[:], r, s) {
+			t.Errorf("%s: the signature does not verify", test.name)
+		}
+	}
+}
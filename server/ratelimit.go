@@ -0,0 +1,297 @@
+package main
+
+/*
+Rate limiting to stop a script hammering the server and using up the
+Let's Encrypt limits or filling the zone with junk records.
+
+There is a token bucket per source IP, applied to every request, and
+one per client ID, applied once the request has been decoded. On top
+of that, certificate issuance has a weekly budget per registered
+domain and a three hourly budget for the ACME account to stay inside
+the Let's Encrypt limits, see https://letsencrypt.org/docs/rate-limits/
+
+Requests over the per IP or per client limits get a 429 with a
+Retry-After header. Certificate requests over the issuance budget are
+queued instead, see scheduler.go.
+
+The budgets are booked before anything is ordered, in the same database
+transaction as the count, so requests arriving together can't all take
+the last certificate. A booking for a certificate that isn't issued is
+released again. Orders count against the account as soon as they are
+placed, whether or not a certificate comes of them, as they do at the
+CA.
+*/
+
+import (
+	"database/sql"
+	"errors"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+// Let's Encrypt counts certificates over a sliding seven day window
+const issuanceWindow = 7 * 24 * time.Hour
+
+// and new orders per account over three hours
+const accountOrderWindow = 3 * time.Hour
+
+// Buckets not used for this long are thrown away
+const limiterIdleTime = 10 * time.Minute
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type limiterSet struct {
+	mutex    sync.Mutex
+	limiters map[string]*limiterEntry
+	rate     rate.Limit
+	burst    int
+}
+
+var ipLimiters *limiterSet
+var clientLimiters *limiterSet
+
+func newLimiterSet(perMinute float64, burst int) *limiterSet {
+	set := &limiterSet{
+		limiters: map[string]*limiterEntry{},
+		rate:     rate.Limit(perMinute / 60),
+		burst:    burst,
+	}
+	go set.cleanup()
+	return set
+}
+
+// Takes a token for the key if there is one, if not says how long until
+// there will be
+func (s *limiterSet) allow(key string) (bool, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(s.rate, s.burst)}
+		s.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+
+	reservation := entry.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func (s *limiterSet) cleanup() {
+	for {
+		time.Sleep(time.Minute)
+		s.mutex.Lock()
+		for key, entry := range s.limiters {
+			if time.Since(entry.lastSeen) > limiterIdleTime {
+				delete(s.limiters, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func initRateLimits() {
+	log.Debugf("Rate limits, per IP: %.1f/minute burst %d, per client: %.1f/minute burst %d, certificates per registered domain per week: %d",
+		Cfg.RateLimits.IPPerMinute, Cfg.RateLimits.IPBurst,
+		Cfg.RateLimits.ClientPerMinute, Cfg.RateLimits.ClientBurst,
+		Cfg.RateLimits.WeeklyCertificates)
+
+	ipLimiters = newLimiterSet(Cfg.RateLimits.IPPerMinute, Cfg.RateLimits.IPBurst)
+	clientLimiters = newLimiterSet(Cfg.RateLimits.ClientPerMinute, Cfg.RateLimits.ClientBurst)
+}
+
+// Whole seconds, rounded up so the client doesn't come back too early
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, retryAfter := ipLimiters.allow(ip); !ok {
+			log.Printf("Rate limiting requests from %s", ip)
+			writeRateLimited(w, retryAfter, "Too many requests from your IP address")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func allowClient(clientID string) (bool, time.Duration) {
+	return clientLimiters.allow(clientID)
+}
+
+// Let's Encrypt counts against the registered domain, e.g. example.com for
+// devices.example.com, so tenants sharing one share the budget
+func registeredDomain(fqdn string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(fqdn)
+	if err != nil {
+		log.Debugf("Could not work out the registered domain for %s, error: %s", fqdn, err)
+		return fqdn
+	}
+	return domain
+}
+
+// Each registered domain once, in the order they first appear
+func registeredDomains(names []string) []string {
+	seen := map[string]bool{}
+	var domains []string
+	for _, name := range names {
+		domain := registeredDomain(strings.TrimPrefix(name, "*."))
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// The rows booked against the weekly budget for a certificate being
+// ordered. Either confirm or release it once the order is done.
+type issuanceReservation struct {
+	uuid  string
+	fqdn  string
+	names []string
+	ids   []int64
+}
+
+// Checks that at least one of the CAs has order budget left then books
+// the certificate against the weekly budget for the registered domains
+// of the names. If either is used up, returns how long until the oldest
+// booking drops out of its window.
+func reserveIssuance(uuid string, fqdn string, names []string) (*issuanceReservation, bool, time.Duration) {
+	var shortest time.Duration
+	accountOK := false
+	for i, ca := range caOrder {
+		ok, retryAfter := accountBudget(ca)
+		if ok {
+			accountOK = true
+			break
+		}
+		if i == 0 || retryAfter < shortest {
+			shortest = retryAfter
+		}
+	}
+	if !accountOK {
+		return nil, false, shortest
+	}
+
+	reservation := &issuanceReservation{uuid: uuid, fqdn: fqdn, names: names}
+	ok, retryAfter := true, time.Duration(0)
+	err := withTransaction(func(tx *sql.Tx) error {
+		counter := func(domain string, since time.Time) (int, time.Time, error) {
+			return countIssuancesIn(tx, domain, since)
+		}
+		domains := registeredDomains(names)
+		for _, domain := range domains {
+			ok, retryAfter = checkBudget("registered domain "+domain, counter, domain, issuanceWindow, Cfg.RateLimits.WeeklyCertificates)
+			if !ok {
+				return nil
+			}
+		}
+		var err error
+		reservation.ids, err = insertPendingIssuances(tx, uuid, fqdn, domains)
+		return err
+	})
+	if err != nil {
+		// As in checkBudget, let it through and record it afterwards
+		log.Printf("Could not book the issuance for %s, error: %s", fqdn, err)
+		return reservation, true, 0
+	}
+	if !ok {
+		return nil, false, retryAfter
+	}
+	return reservation, true, 0
+}
+
+func (r *issuanceReservation) confirm(ca *certificateAuthority) {
+	if r.ids == nil {
+		recordIssuance(r.uuid, r.fqdn, r.names, ca)
+		return
+	}
+	if err := confirmIssuances(r.ids, ca); err != nil {
+		log.Printf("Could not record the issuance for %s, error: %s", r.fqdn, err)
+	}
+}
+
+func (r *issuanceReservation) release() {
+	if err := deletePendingIssuances(r.ids); err != nil {
+		log.Printf("Could not release the booking for %s, error: %s", r.fqdn, err)
+	}
+}
+
+// The order budget for the CA's account, an account that hasn't been
+// registered yet hasn't ordered anything
+func accountBudget(ca *certificateAuthority) (bool, time.Duration) {
+	account := ca.accountURI()
+	if account == "" {
+		return true, 0
+	}
+	return checkBudget("account "+account, countAccountOrders, account, accountOrderWindow, Cfg.RateLimits.AccountOrders)
+}
+
+// Books an order against the account just before it is placed. Fails
+// with a rateLimitedError if the budget is used up so the next CA is
+// tried.
+func reserveOrder(ca *certificateAuthority) error {
+	account := ca.accountURI()
+	ok, retryAfter := true, time.Duration(0)
+	err := withTransaction(func(tx *sql.Tx) error {
+		counter := func(account string, since time.Time) (int, time.Time, error) {
+			return countAccountOrdersIn(tx, account, since)
+		}
+		ok, retryAfter = checkBudget("account "+account, counter, account, accountOrderWindow, Cfg.RateLimits.AccountOrders)
+		if !ok {
+			return nil
+		}
+		return insertOrder(tx, ca, account)
+	})
+	if err != nil {
+		log.Printf("Could not record the order with %s, error: %s", ca.Name, err)
+		return nil
+	}
+	if !ok {
+		return rateLimitedError{retryAfter: retryAfter, err: errors.New("Order budget used up")}
+	}
+	return nil
+}
+
+func checkBudget(name string, counter func(string, time.Time) (int, time.Time, error), key string, window time.Duration, limit int) (bool, time.Duration) {
+	count, oldest, err := counter(key, time.Now().Add(-window))
+	if err != nil {
+		// Better to let the request through and have Let's Encrypt say no
+		// than to block everything on a database problem
+		log.Printf("Could not check the issuance budget for %s, error: %s", name, err)
+		return true, 0
+	}
+	log.Debugf("Used for %s in the last %s: %d of %d", name, window, count, limit)
+	if count < limit {
+		return true, 0
+	}
+	return false, time.Until(oldest.Add(window))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"github.com/digininja/ots-cert-demo/server/config"
+	"golang.org/x/time/rate"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiterSet(t *testing.T) {
+	// One a minute with a burst of two, so the third in a row has to wait
+	set := &limiterSet{limiters: map[string]*limiterEntry{}, rate: rate.Limit(1.0 / 60), burst: 2}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"a", true},
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"a", false},
+	}
+	for i, test := range tests {
+		ok, retryAfter := set.allow(test.key)
+		if ok != test.want {
+			t.Errorf("request %d for %s: allowed %t, want %t", i, test.key, ok, test.want)
+		}
+		if !ok && (retryAfter <= 0 || retryAfter > time.Minute) {
+			t.Errorf("request %d for %s: retry after %s", i, test.key, retryAfter)
+		}
+	}
+}
+
+func TestRegisteredDomains(t *testing.T) {
+	got := registeredDomains([]string{"a.devices.example.com", "*.a.devices.example.com", "b.example.co.uk", "c.example.com"})
+	want := []string{"example.com", "example.co.uk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registeredDomains = %v, want %v", got, want)
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	oldest := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name    string
+		count   int
+		err     error
+		limit   int
+		ok      bool
+		waitMin time.Duration
+	}{
+		{"under", 4, nil, 5, true, 0},
+		{"at the limit", 5, nil, 5, false, 2*time.Hour - time.Minute},
+		{"over", 6, nil, 5, false, 2*time.Hour - time.Minute},
+		{"database error", 0, errors.New("broken"), 5, true, 0},
+	}
+	for _, test := range tests {
+		counter := func(key string, since time.Time) (int, time.Time, error) {
+			return test.count, oldest, test.err
+		}
+		ok, retryAfter := checkBudget(test.name, counter, "key", 3*time.Hour, test.limit)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %t, want %t", test.name, ok, test.ok)
+		}
+		if !ok && (retryAfter < test.waitMin || retryAfter > 2*time.Hour) {
+			t.Errorf("%s: retry after %s", test.name, retryAfter)
+		}
+	}
+}
+
+func testCA(account string) *certificateAuthority {
+	return &certificateAuthority{CAProfile: config.CAProfile{Name: "test"}, account: account}
+}
+
+func TestReserveIssuance(t *testing.T) {
+	testDatabase(t)
+	Cfg.RateLimits.WeeklyCertificates = 2
+	Cfg.RateLimits.AccountOrders = 10
+	ca := testCA("https://ca.example/acct/1")
+	caOrder = []*certificateAuthority{ca}
+	defer func() { caOrder = nil }()
+
+	names := []string{"a.example.com", "a.example.net"}
+
+	first, ok, _ := reserveIssuance("1", "a.example.com", names)
+	if !ok {
+		t.Fatal("The first certificate was refused")
+	}
+	second, ok, _ := reserveIssuance("2", "b.example.com", []string{"b.example.com"})
+	if !ok {
+		t.Fatal("The second certificate was refused")
+	}
+	// example.com is used up, pending or not
+	if _, ok, retryAfter := reserveIssuance("3", "c.example.com", []string{"c.example.com"}); ok || retryAfter <= 0 {
+		t.Fatalf("A third certificate for example.com was booked, retry after %s", retryAfter)
+	}
+	// example.net still has room
+	if _, ok, _ := reserveIssuance("4", "d.example.net", []string{"d.example.net"}); !ok {
+		t.Fatal("example.net was refused")
+	}
+
+	// A failed order gives its booking back
+	second.release()
+	third, ok, _ := reserveIssuance("3", "c.example.com", []string{"c.example.com"})
+	if !ok {
+		t.Fatal("The released booking was not given back")
+	}
+
+	first.confirm(ca)
+	third.confirm(ca)
+	count, _, err := countIssuances("example.com", time.Now().Add(-issuanceWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("%d issuances counted for example.com, want 2", count)
+	}
+	var pending int
+	database.QueryRow("SELECT COUNT(*) FROM issuances WHERE registered_domain = 'example.com' AND pending = 1").Scan(&pending)
+	if pending != 0 {
+		t.Errorf("%d issuances are still pending after being confirmed", pending)
+	}
+}
+
+func TestReserveOrder(t *testing.T) {
+	testDatabase(t)
+	Cfg.RateLimits.AccountOrders = 2
+	ca := testCA("https://ca.example/acct/1")
+	other := testCA("https://ca.example/acct/2")
+
+	tests := []struct {
+		ca      *certificateAuthority
+		limited bool
+	}{
+		{ca, false},
+		{ca, false},
+		{ca, true},
+		{other, false},
+		{ca, true},
+	}
+	for i, test := range tests {
+		err := reserveOrder(test.ca)
+		_, limited := err.(rateLimitedError)
+		if limited != test.limited {
+			t.Errorf("order %d for %s: error %v, want limited %t", i, test.ca.account, err, test.limited)
+		}
+	}
+
+	// Orders count whether or not they issued
+	if ok, _ := accountBudget(ca); ok {
+		t.Error("accountBudget says there is room after the limit was reached")
+	}
+}
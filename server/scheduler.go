@@ -0,0 +1,232 @@
+package main
+
+/*
+Certificate requests which would go over the Let's Encrypt limits are
+put in a queue in the database rather than being refused. The client
+gets a 202 with a Retry-After header and keeps asking until the
+certificate is ready.
+
+The scheduler works through the queue, issuing anything whose
+not_before time has passed and there is quota for. If the CA says no
+with a rateLimited problem, the request is pushed back by as long as
+it asks. When a factory batch of devices boots at once this spreads
+the issuance out instead of failing most of them.
+*/
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/pem"
+	"github.com/digininja/ots-cert-demo/interop"
+	"net/http"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const (
+	queueStatusQueued = "queued"
+	queueStatusIssued = "issued"
+	queueStatusFailed = "failed"
+)
+
+type queuedCertificate struct {
+	uuid         string
+	fqdn         string
+	csr          []byte
+	notBefore    time.Time
+	status       string
+	certificates [][]byte
+	message      string
+}
+
+// Adds the request to the queue, replacing anything already there for
+// the client
+func queueCertificate(uuid string, fqdn string, csr []byte, notBefore time.Time) error {
+	log.Debugf("Queueing the certificate for %s until %s", fqdn, notBefore)
+	_, err := database.Exec("INSERT OR REPLACE INTO certificate_queue (uuid, fqdn, csr, not_before, status) VALUES (?,?,?,?,?)",
+		uuid, fqdn, csr, notBefore.Unix(), queueStatusQueued)
+	return err
+}
+
+func scanQueued(scanner interface{ Scan(...interface{}) error }) (*queuedCertificate, error) {
+	var q queuedCertificate
+	var notBefore int64
+	var certificates []byte
+	var message sql.NullString
+	if err := scanner.Scan(&q.uuid, &q.fqdn, &q.csr, &notBefore, &q.status, &certificates, &message); err != nil {
+		return nil, err
+	}
+	q.notBefore = time.Unix(notBefore, 0)
+	q.certificates = decodeCertificates(certificates)
+	q.message = message.String
+	return &q, nil
+}
+
+// Returns nil if there is nothing queued for the client
+func getQueued(uuid string) (*queuedCertificate, error) {
+	row := database.QueryRow("SELECT uuid, fqdn, csr, not_before, status, certificates, message FROM certificate_queue WHERE uuid = ?", uuid)
+	q, err := scanQueued(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return q, err
+}
+
+func dueQueued(now time.Time) ([]*queuedCertificate, error) {
+	rows, err := database.Query("SELECT uuid, fqdn, csr, not_before, status, certificates, message FROM certificate_queue WHERE status = ? AND not_before <= ? ORDER BY not_before",
+		queueStatusQueued, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []*queuedCertificate
+	for rows.Next() {
+		q, err := scanQueued(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, q)
+	}
+	return due, rows.Err()
+}
+
+func queueLength() (int, error) {
+	var count int
+	err := database.QueryRow("SELECT COUNT(*) FROM certificate_queue WHERE status = ?", queueStatusQueued).Scan(&count)
+	return count, err
+}
+
+func rescheduleQueued(uuid string, notBefore time.Time) {
+	if _, err := database.Exec("UPDATE certificate_queue SET not_before = ? WHERE uuid = ?", notBefore.Unix(), uuid); err != nil {
+		log.Printf("Could not reschedule the queued certificate for %s, error: %s", uuid, err)
+	}
+}
+
+func updateQueuedCSR(uuid string, csr []byte) error {
+	_, err := database.Exec("UPDATE certificate_queue SET csr = ? WHERE uuid = ?", csr, uuid)
+	return err
+}
+
+func finishQueued(uuid string, status string, certificates [][]byte, message string) {
+	_, err := database.Exec("UPDATE certificate_queue SET status = ?, certificates = ?, message = ? WHERE uuid = ?",
+		status, encodeCertificates(certificates), message, uuid)
+	if err != nil {
+		log.Printf("Could not update the queued certificate for %s, error: %s", uuid, err)
+	}
+}
+
+func deleteQueued(uuid string) {
+	if _, err := database.Exec("DELETE FROM certificate_queue WHERE uuid = ?", uuid); err != nil {
+		log.Printf("Could not remove the queued certificate for %s, error: %s", uuid, err)
+	}
+}
+
+func encodeCertificates(certificates [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, certificate := range certificates {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	}
+	return buf.Bytes()
+}
+
+func decodeCertificates(data []byte) [][]byte {
+	var certificates [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certificates
+		}
+		certificates = append(certificates, block.Bytes)
+	}
+}
+
+// How long to tell a client to wait before asking again. There is no
+// point coming back before the next run of the scheduler.
+func queuedRetryAfter(notBefore time.Time) time.Duration {
+	wait := time.Until(notBefore)
+	if interval := time.Duration(Cfg.RateLimits.QueueInterval) * time.Second; wait < interval {
+		wait = interval
+	}
+	return wait
+}
+
+func writeQueued(w http.ResponseWriter, retryAfter time.Duration, response interop.CertificateResponse) {
+	seconds := setRetryAfter(w, retryAfter)
+	log.Debugf("Returning a 202 to the user, retry after %d seconds: %s", seconds, response.Message)
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+func processQueue() {
+	due, err := dueQueued(time.Now())
+	if err != nil {
+		log.Printf("Could not read the certificate queue, error: %s", err)
+		return
+	}
+	if len(due) > 0 {
+		log.Debugf("Certificate requests due from the queue: %d", len(due))
+	}
+
+	for _, q := range due {
+		// The CSR was checked before it was queued so the names in it are
+		// the ones to order
+		csr, err := parseCSR(q.csr)
+		if err != nil {
+			finishQueued(q.uuid, queueStatusFailed, nil, err.Error())
+			continue
+		}
+		names := csrNames(csr)
+
+		// The profile comes from the tenant the client is in now
+		profile := ""
+		if t, err := tenantByName(getClient(q.uuid).tenant); err == nil {
+			profile = t.CertificateProfile
+		}
+
+		reservation, ok, retryAfter := reserveIssuance(q.uuid, q.fqdn, names)
+		if !ok {
+			log.Debugf("Still no quota for %s, trying again in %s", q.fqdn, retryAfter)
+			rescheduleQueued(q.uuid, time.Now().Add(retryAfter))
+			continue
+		}
+
+		log.Printf("Issuing the queued certificate for %s", q.fqdn)
+		certificates, ca, err := GenerateCertificate(context.Background(), q.csr, names, profile)
+		if err != nil {
+			reservation.release()
+		}
+		if limited, ok := err.(rateLimitedError); ok {
+			rescheduleQueued(q.uuid, time.Now().Add(limited.retryAfter))
+			continue
+		}
+		// Left as it is so it is due again on the next check
+		if _, unavailable := err.(caUnavailableError); unavailable {
+			log.Printf("Could not issue the queued certificate for %s, trying again later, error: %s", q.fqdn, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not issue the queued certificate for %s, error: %s", q.fqdn, err)
+			finishQueued(q.uuid, queueStatusFailed, nil, err.Error())
+			continue
+		}
+		reservation.confirm(ca)
+		recordCertificate(q.uuid, q.fqdn, ca, profile, certificates)
+		finishQueued(q.uuid, queueStatusIssued, certificates, "done")
+	}
+}
+
+func runScheduler() {
+	interval := time.Duration(Cfg.RateLimits.QueueInterval) * time.Second
+	log.Debugf("Checking the certificate queue and renewal information every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			processQueue()
+			refreshRenewalInfo()
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"github.com/digininja/ots-cert-demo/server/config"
+	"golang.org/x/crypto/acme"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueTransitions(t *testing.T) {
+	testDatabase(t)
+	now := time.Now()
+
+	if err := queueCertificate("due", "due.example.com", []byte("csr1"), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueCertificate("later", "later.example.com", []byte("csr2"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	dueUUIDs := func() []string {
+		due, err := dueQueued(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uuids []string
+		for _, q := range due {
+			uuids = append(uuids, q.uuid)
+		}
+		return uuids
+	}
+
+	certificates := [][]byte{[]byte("leaf"), []byte("intermediate")}
+	steps := []struct {
+		name    string
+		action  func()
+		due     []string
+		queued  int
+		status  string
+		message string
+	}{
+		{"queued", func() {}, []string{"due"}, 2, queueStatusQueued, ""},
+		{"rescheduled", func() { rescheduleQueued("due", now.Add(time.Hour)) }, nil, 2, queueStatusQueued, ""},
+		{"due again", func() { rescheduleQueued("due", now.Add(-time.Second)) }, []string{"due"}, 2, queueStatusQueued, ""},
+		{"issued", func() { finishQueued("due", queueStatusIssued, certificates, "done") }, nil, 1, queueStatusIssued, "done"},
+		{"queued again", func() { queueCertificate("due", "due.example.com", []byte("csr3"), now.Add(-time.Second)) }, []string{"due"}, 2, queueStatusQueued, ""},
+		{"failed", func() { finishQueued("due", queueStatusFailed, nil, "no") }, nil, 1, queueStatusFailed, "no"},
+	}
+	for _, step := range steps {
+		step.action()
+		if got := dueUUIDs(); !reflect.DeepEqual(got, step.due) {
+			t.Errorf("%s: due %v, want %v", step.name, got, step.due)
+		}
+		if queued, err := queueLength(); err != nil || queued != step.queued {
+			t.Errorf("%s: queue length %d (%v), want %d", step.name, queued, err, step.queued)
+		}
+		q, err := getQueued("due")
+		if err != nil || q == nil {
+			t.Fatalf("%s: getQueued = %v, %v", step.name, q, err)
+		}
+		if q.status != step.status || q.message != step.message {
+			t.Errorf("%s: status %q message %q, want %q %q", step.name, q.status, q.message, step.status, step.message)
+		}
+		if step.status == queueStatusIssued && !reflect.DeepEqual(q.certificates, certificates) {
+			t.Errorf("%s: certificates %q, want %q", step.name, q.certificates, certificates)
+		}
+	}
+
+	deleteQueued("due")
+	if q, err := getQueued("due"); q != nil || err != nil {
+		t.Errorf("getQueued after delete = %v, %v", q, err)
+	}
+}
+
+func TestProcessQueueErrors(t *testing.T) {
+	testDatabase(t)
+	Cfg.RateLimits.WeeklyCertificates = 50
+	Cfg.RateLimits.AccountOrders = 300
+	defer func() { caOrder = nil }()
+
+	// Nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := "http://" + listener.Addr().String() + "/directory"
+	listener.Close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &certificateAuthority{CAProfile: config.CAProfile{Name: "down"}, client: &acme.Client{Key: key, DirectoryURL: directory}}
+
+	// A CA which turns the account down, which won't change by asking again
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			writeJSON(w, http.StatusOK, map[string]string{"newNonce": server.URL + "/nonce", "newAccount": server.URL + "/account", "newOrder": server.URL + "/order"})
+		case "/nonce":
+			w.Header().Set("Replay-Nonce", "nonce")
+		default:
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"No accounts here"}`))
+		}
+	}))
+	defer server.Close()
+	refusing := &certificateAuthority{CAProfile: config.CAProfile{Name: "refusing"}, client: &acme.Client{Key: key, DirectoryURL: server.URL + "/directory"}}
+
+	csr := testCSR(t, x509.CertificateRequest{DNSNames: []string{"host.example.com"}})
+	tests := []struct {
+		name   string
+		cas    []*certificateAuthority
+		status string
+		due    bool
+	}{
+		// Worth trying again when the CA is back
+		{"CA down", []*certificateAuthority{down}, queueStatusQueued, true},
+		{"account refused", []*certificateAuthority{refusing}, queueStatusFailed, false},
+	}
+	for _, test := range tests {
+		caOrder = test.cas
+		if err := queueCertificate("1", "host.example.com", csr, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		processQueue()
+
+		q, err := getQueued("1")
+		if err != nil || q == nil {
+			t.Fatalf("%s: getQueued = %v, %v", test.name, q, err)
+		}
+		if q.status != test.status {
+			t.Errorf("%s: status %s, want %s", test.name, q.status, test.status)
+		}
+		due, err := dueQueued(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(due) == 1) != test.due {
+			t.Errorf("%s: %d due, want due %t", test.name, len(due), test.due)
+		}
+		var pending int
+		database.QueryRow("SELECT COUNT(*) FROM issuances").Scan(&pending)
+		if pending != 0 {
+			t.Errorf("%s: %d issuances booked after the order failed", test.name, pending)
+		}
+		deleteQueued("1")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+/*
+Each tenant issues certificates under its own domain with its own
+Cloudflare account, enrollment tokens, hostname policy and quota.
+
+The top level of the config file makes up the default tenant, which
+the server uses for its own certificate. Clients pick a tenant by the
+enrollment token they register with. A client that sends no token goes
+to the default tenant as long as it has no tokens configured.
+*/
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/digininja/ots-cert-demo/server/config"
+	mathrand "math/rand"
+	"time"
+)
+
+import log "github.com/sirupsen/logrus"
+
+const defaultTenantName = "default"
+
+type tenant struct {
+	config.Tenant
+	generator HostnameGenerator
+	ipPolicy  *ipPolicy
+}
+
+var tenants = map[string]*tenant{}
+var defaultTenant *tenant
+
+var errBadEnrollmentToken = errors.New("The enrollment token is not valid")
+
+func initTenants() {
+	log.Debug("Setting up the tenants")
+
+	// This is needed to ensure the random number generated to create
+	// the name is actually random
+	mathrand.Seed(time.Now().UTC().UnixNano())
+
+	all := append([]config.Tenant{{
+		Name:               defaultTenantName,
+		Domain:             Cfg.Domain,
+		EnrollmentTokens:   Cfg.EnrollmentTokens,
+		MaxClients:         Cfg.MaxClients,
+		Wildcard:           Cfg.Wildcard,
+		ExtraNames:         Cfg.ExtraNames,
+		CertificateProfile: Cfg.CertificateProfile,
+		CloudflareCreds:    Cfg.CloudflareCreds,
+		Hostnames:          Cfg.Hostnames,
+		RegistrationIPs:    Cfg.RegistrationIPs,
+	}}, Cfg.Tenants...)
+
+	for _, t := range all {
+		if t.Name == "" || t.Domain == "" {
+			log.Fatal("Every tenant needs a name and a domain")
+		}
+		if _, exists := tenants[t.Name]; exists {
+			log.Fatalf("The tenant name is used more than once: %s", t.Name)
+		}
+
+		log.Debugf("Tenant %s issues under the domain %s using the %s hostname generator", t.Name, t.Domain, t.Hostnames.Generator)
+		generator, err := newHostnameGenerator(t.Hostnames)
+		if err != nil {
+			log.Fatalf("Hostname generator error for tenant %s: %s", t.Name, err)
+		}
+		policy, err := newIPPolicy(t.RegistrationIPs.Allow, t.RegistrationIPs.Deny)
+		if err != nil {
+			log.Fatalf("Registration IP policy error for tenant %s: %s", t.Name, err)
+		}
+		tenants[t.Name] = &tenant{Tenant: t, generator: generator, ipPolicy: policy}
+	}
+	defaultTenant = tenants[defaultTenantName]
+}
+
+// Finds the tenant the token belongs to
+func tenantForToken(token string) (*tenant, error) {
+	if token == "" {
+		if len(defaultTenant.EnrollmentTokens) == 0 {
+			return defaultTenant, nil
+		}
+		return nil, errBadEnrollmentToken
+	}
+	for _, t := range tenants {
+		for _, valid := range t.EnrollmentTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+				return t, nil
+			}
+		}
+	}
+	return nil, errBadEnrollmentToken
+}
+
+func tenantByName(name string) (*tenant, error) {
+	if t, ok := tenants[name]; ok {
+		return t, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown tenant: %s", name))
+}
+
+func (t *tenant) fqdn(hostname string) string {
+	return fmt.Sprintf("%s.%s", hostname, t.Domain)
+}
+
+// Whether the server has credentials for the tenant's zone, without them
+// clients can't be given address records. Extra domains use the same
+// credentials so are managed if the main one is.
+func (t *tenant) managesAddresses() bool {
+	_, err := zoneFor(t.Domain)
+	return err == nil
+}
+
+// The names a client's certificate covers, in wildcard mode the apex
+// name plus the wildcard under it, followed by any extra names it has
+// been given. The CSR has to contain exactly these.
+func (t *tenant) certificateNames(hostname string, extra []string) []string {
+	fqdn := t.fqdn(hostname)
+	names := []string{fqdn}
+	if t.Wildcard {
+		names = append(names, "*."+fqdn)
+	}
+	return append(names, extra...)
+}
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"github.com/digininja/ots-cert-demo/interop"
-	"github.com/docker/docker/pkg/namesgenerator"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	// The reason for the underscore is described here
 	// https://stackoverflow.com/questions/21220077/what-does-an-underscore-in-front-of-an-import-statement-mean
-	"math/rand"
-	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -25,9 +21,11 @@ To call the server:
 
 It will take the UUID in different formats but convert it to the first one after successfully parsing
 
-curl localhost:8080/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"eca2450a-482d-4b4b-baa5-9ff0daec19e9"}'
-curl localhost:8080/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"URN:UUID:f47ac10b-58cc-4372-0567-0e02b2c3d479"}'
-curl localhost:8080/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"eca2450a482d4b4bbaa59ff0daec19e9"}'
+curl localhost:8080/v1/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"eca2450a-482d-4b4b-baa5-9ff0daec19e9"}'
+curl localhost:8080/v1/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"URN:UUID:f47ac10b-58cc-4372-0567-0e02b2c3d479"}'
+curl localhost:8080/v1/register -i -X POST -H "Content-Type: application/json" --data '{"clientID":"eca2450a482d4b4bbaa59ff0daec19e9"}'
+
+Errors come back with a status to match and an error object, see api.go.
 
 For now, this will return a UUID:
 
@@ -49,34 +47,16 @@ type Profile struct {
 // Good snippets
 // https://www.alexedwards.net/blog/golang-response-snippets
 
-func generateHostname() string {
-	// This is needed to ensure the random number generated to create
-	// the name is actually random
-	rand.Seed(time.Now().UTC().UnixNano())
-	hostname := namesgenerator.GetRandomName(0)
-
-	// underscore not allowed in the hostname so having to swap for a hyphen
-	hostname = strings.Replace(hostname, "_", "-", -1)
-
-	return hostname
-}
-
-func writeError(w http.ResponseWriter, msg string) {
-	//http.Error(w, msg, http.StatusInternalServerError)
-	w.WriteHeader(http.StatusInternalServerError)
-	log.Debugf("Returning a 500 to the user: %s", msg)
-	w.Write([]byte(msg))
-}
-
 type Client struct {
 	uuid     string
 	hostname string
 	ip       string
+	tenant   string
 }
 
 func getClient(uuid string) Client {
 	log.Debugf("Loading client from database, UUID: %s", uuid)
-	rows, err := database.Query("SELECT uuid, hostname, IP FROM clients WHERE uuid = ?", uuid)
+	rows, err := database.Query("SELECT uuid, hostname, IP, tenant FROM clients WHERE uuid = ?", uuid)
 	if err != nil {
 		log.Fatalf("Error loading client from database, error: %s", err)
 	}
@@ -84,11 +64,11 @@ func getClient(uuid string) Client {
 	var client Client
 	row_count := 0
 	for rows.Next() {
-		err := rows.Scan(&client.uuid, &client.hostname, &client.ip)
+		err := rows.Scan(&client.uuid, &client.hostname, &client.ip, &client.tenant)
 		if err != nil {
 			log.Fatalf("Error scanning returned rows, error: %s", err)
 		}
-		log.Debugf("Client found, UUID: %s, Hostname: %s, IP: %s", client.uuid, client.hostname, client.ip)
+		log.Debugf("Client found, UUID: %s, Hostname: %s, IP: %s, Tenant: %s", client.uuid, client.hostname, client.ip, client.tenant)
 		row_count++
 	}
 	log.Debugf("Number of rows returned %d", row_count)
@@ -112,16 +92,7 @@ func generateCertificate(w http.ResponseWriter, r *http.Request) {
 	var emptyBytes [][]byte
 
 	var certificaterRequest interop.CertificateRequest
-	err := json.NewDecoder(r.Body).Decode(&certificaterRequest)
-
-	// error doesn't seem to do much. It DOES NOT pick up on fields that have been missed
-	// see https://github.com/golang/go/issues/10140 and https://stackoverflow.com/questions/19633763/unmarshaling-json-in-golang-required-field
-	if err != nil {
-		log.Printf("Invalid request, aborting")
-		log.Debugf("There was an error decoding the JSON: %s", err)
-		certificateResponse := interop.CertificateResponse{Certificates: emptyBytes, Success: false, Message: fmt.Sprintf("Error decoding the JSON\nError message: %s", err)}
-		s := certificateResponse.Marshall()
-		writeError(w, s)
+	if !decodeRequest(w, r, &certificaterRequest) {
 		return
 	}
 
@@ -130,9 +101,13 @@ func generateCertificate(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Invalid request, aborting")
 		msg := (fmt.Sprintf("Client ID was not in the expected format: %s", certificaterRequest.ClientID))
 		log.Debugf("%s", msg)
-		certificateResponse := interop.CertificateResponse{Certificates: emptyBytes, Success: false, Message: msg}
-		s := certificateResponse.Marshall()
-		writeError(w, s)
+		writeFailure(w, interop.ErrInvalidClientID, msg)
+		return
+	}
+
+	if ok, retryAfter := allowClient(parsedUuid.String()); !ok {
+		log.Printf("Rate limiting certificate requests from client %s", parsedUuid.String())
+		writeRateLimited(w, retryAfter, "Too many requests from this client")
 		return
 	}
 
@@ -141,10 +116,19 @@ func generateCertificate(w http.ResponseWriter, r *http.Request) {
 	if client == (Client{}) {
 		log.Printf("Invalid request, aborting")
 		log.Debugf("Client not found")
+		writeFailure(w, interop.ErrUnknownClient, "The client is not registered")
 		return
 	}
 	log.Debugf("Request is for: UUID %s, Hostname %s, IP %s", client.uuid, client.hostname, client.ip)
 
+	clientTenant, err := tenantByName(client.tenant)
+	if err != nil {
+		log.Printf("Invalid request, aborting")
+		log.Debugf("%s", err)
+		writeFailure(w, interop.ErrUnknownTenant, "The client's tenant no longer exists")
+		return
+	}
+
 	certificaterRequest.ClientID = parsedUuid.String()
 	log.Debugf("The client ID is: %s", certificaterRequest.ClientID)
 
@@ -170,63 +154,242 @@ func generateCertificate(w http.ResponseWriter, r *http.Request) {
 	// Need to read the hostname out of the database, can't trust the entry in the CSR
 	// and can't ask the user to send it in
 
-	fqdn := fmt.Sprintf("%s.%s", client.hostname, Cfg.Domain)
-	certificates, err := GenerateCertificate(certificaterRequest.CSR, fqdn)
+	fqdn := clientTenant.fqdn(client.hostname)
+	extraNames, err := getClientNames(client.uuid)
+	if err != nil {
+		log.Printf("Could not load the client's names, error: %s", err)
+		writeFailure(w, interop.ErrInternal, "Could not generate the certificate")
+		return
+	}
+	names := clientTenant.certificateNames(client.hostname, extraNames)
+
+	if err := checkCSR(certificaterRequest.CSR, names); err != nil {
+		log.Printf("Invalid CSR, aborting")
+		log.Debugf("%s", err)
+		writeFailure(w, interop.ErrInvalidCSR, err.Error())
+		return
+	}
 
-	certificateResponse := interop.CertificateResponse{Certificates: certificates, Success: true, Message: "done"}
-	js, err := json.Marshal(certificateResponse)
+	// Anything already in the queue for the client is dealt with first
+	queued, err := getQueued(client.uuid)
 	if err != nil {
-		log.Fatalf(fmt.Sprintf("Error marshalling the JSON request, error: %s", err.Error()))
+		log.Printf("Could not check the certificate queue, error: %s", err)
+		writeFailure(w, interop.ErrInternal, "Could not generate the certificate")
 		return
 	}
-	s := string(js[:])
+	if queued != nil && queued.fqdn != fqdn {
+		// The client has been given a new name since it was queued
+		deleteQueued(client.uuid)
+		queued = nil
+	}
+	if queued != nil && !bytes.Equal(queued.csr, certificaterRequest.CSR) && queued.status != queueStatusQueued {
+		// Issued or failed for a CSR the client has since thrown away
+		deleteQueued(client.uuid)
+		queued = nil
+	}
+	if queued != nil {
+		switch queued.status {
+		case queueStatusIssued:
+			log.Printf("Returning the queued certificate for %s", fqdn)
+			deleteQueued(client.uuid)
+			renewal, err := getRenewalInfo(client.uuid)
+			if err != nil {
+				log.Printf("Could not read the renewal information, error: %s", err)
+			}
+			certificateResponse := interop.CertificateResponse{Certificates: queued.certificates, Success: true, Message: "done", Staging: Cfg.ACME.Staging, Profile: clientTenant.CertificateProfile, Renewal: renewal}
+			writeJSON(w, http.StatusOK, certificateResponse)
+			return
+		case queueStatusFailed:
+			log.Printf("The queued certificate for %s failed: %s", fqdn, queued.message)
+			deleteQueued(client.uuid)
+			writeFailure(w, interop.ErrIssuanceFailed, queued.message)
+			return
+		default:
+			if !bytes.Equal(queued.csr, certificaterRequest.CSR) {
+				log.Debug("The client has sent a new CSR, updating the queue")
+				if err := updateQueuedCSR(client.uuid, certificaterRequest.CSR); err != nil {
+					log.Printf("Could not update the queued CSR, error: %s", err)
+				}
+			}
+			log.Printf("The certificate for %s is still queued", fqdn)
+			certificateResponse := interop.CertificateResponse{Certificates: emptyBytes, Success: false, Queued: true, Message: "The certificate request is queued"}
+			writeQueued(w, queuedRetryAfter(queued.notBefore), certificateResponse)
+			return
+		}
+	}
+
+	// Near the limits, queue the request rather than failing it
+	var certificates [][]byte
+	var ca *certificateAuthority
+	reservation, ok, retryAfter := reserveIssuance(client.uuid, fqdn, names)
+	if ok {
+		certificates, ca, err = GenerateCertificate(r.Context(), certificaterRequest.CSR, names, clientTenant.CertificateProfile)
+		if err != nil {
+			reservation.release()
+		}
+		if limited, isLimited := err.(rateLimitedError); isLimited {
+			ok = false
+			retryAfter = limited.retryAfter
+		}
+	}
+	if !ok {
+		log.Printf("No certificate quota for %s, queueing the request", fqdn)
+		notBefore := time.Now().Add(retryAfter)
+		if err := queueCertificate(client.uuid, fqdn, certificaterRequest.CSR, notBefore); err != nil {
+			log.Printf("Could not queue the certificate request, error: %s", err)
+			writeFailure(w, interop.ErrInternal, "Could not generate the certificate")
+			return
+		}
+		certificateResponse := interop.CertificateResponse{Certificates: emptyBytes, Success: false, Queued: true, Message: "The certificate limit has been reached, the request has been queued"}
+		writeQueued(w, queuedRetryAfter(notBefore), certificateResponse)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not generate the certificate, error: %s", err)
+		code := interop.ErrIssuanceFailed
+		if _, unavailable := err.(caUnavailableError); unavailable {
+			code = interop.ErrCAUnavailable
+		}
+		writeFailure(w, code, err.Error())
+		return
+	}
+	reservation.confirm(ca)
+	renewal := recordCertificate(client.uuid, fqdn, ca, clientTenant.CertificateProfile, certificates)
+
+	certificateResponse := interop.CertificateResponse{Certificates: certificates, Success: true, Message: "done", Staging: Cfg.ACME.Staging, Profile: clientTenant.CertificateProfile, Renewal: renewal}
 
 	log.Print("Certificate generated and being returned to the client")
 
-	fmt.Fprintf(w, s)
+	writeJSON(w, http.StatusOK, certificateResponse)
 }
 
-var privateIPBlocks []*net.IPNet
+// Lets a client check whether the CA has moved its renewal window since
+// the certificate was issued
+func renewalInfo(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Call to get renewal information")
+
+	var renewalRequest interop.RenewalInfoRequest
+	if !decodeRequest(w, r, &renewalRequest) {
+		return
+	}
 
-func init() {
-	for _, cidr := range []string{
-		//"127.0.0.0/8",    // IPv4 loopback
-		"10.0.0.0/8",     // RFC1918
-		"172.16.0.0/12",  // RFC1918
-		"192.168.0.0/16", // RFC1918
-		//"::1/128",        // IPv6 loopback
-		//"fe80::/10",      // IPv6 link-local
-	} {
-		_, block, _ := net.ParseCIDR(cidr)
-		privateIPBlocks = append(privateIPBlocks, block)
+	parsedUuid, err := uuid.Parse(renewalRequest.ClientID)
+	if err != nil {
+		log.Printf("Invalid request, aborting")
+		msg := fmt.Sprintf("Client ID was not in the expected format: %s", renewalRequest.ClientID)
+		writeFailure(w, interop.ErrInvalidClientID, msg)
+		return
 	}
+
+	if ok, retryAfter := allowClient(parsedUuid.String()); !ok {
+		log.Printf("Rate limiting renewal information requests from client %s", parsedUuid.String())
+		writeRateLimited(w, retryAfter, "Too many requests from this client")
+		return
+	}
+
+	renewal, err := getRenewalInfo(parsedUuid.String())
+	if err != nil {
+		log.Printf("Could not read the renewal information, error: %s", err)
+		writeFailure(w, interop.ErrInternal, "Could not read the renewal information")
+		return
+	}
+	if renewal == nil {
+		writeFailure(w, interop.ErrNoCertificate, "No certificate has been issued to this client")
+		return
+	}
+
+	renewalResponse := interop.RenewalInfoResponse{Success: true, Message: "done", Renewal: renewal}
+	writeJSON(w, http.StatusOK, renewalResponse)
 }
 
-func isPrivateIP(ip net.IP) bool {
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true
+// For devices which have moved network or been given a new lease. The
+// same IP policy as registration applies.
+func updateIP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Call to update a client's IP addresses")
+
+	var updateRequest interop.UpdateIPRequest
+	if !decodeRequest(w, r, &updateRequest) {
+		return
+	}
+
+	parsedUuid, err := uuid.Parse(updateRequest.ClientID)
+	if err != nil {
+		log.Printf("Invalid request, aborting")
+		msg := fmt.Sprintf("Client ID was not in the expected format: %s", updateRequest.ClientID)
+		writeFailure(w, interop.ErrInvalidClientID, msg)
+		return
+	}
+
+	if ok, retryAfter := allowClient(parsedUuid.String()); !ok {
+		log.Printf("Rate limiting IP updates from client %s", parsedUuid.String())
+		writeRateLimited(w, retryAfter, "Too many requests from this client")
+		return
+	}
+
+	client := getClient(parsedUuid.String())
+	if client == (Client{}) {
+		log.Printf("Invalid request, aborting")
+		writeFailure(w, interop.ErrUnknownClient, "The client is not registered")
+		return
+	}
+
+	clientTenant, err := tenantByName(client.tenant)
+	if err != nil {
+		log.Printf("Invalid request, aborting")
+		log.Debugf("%s", err)
+		writeFailure(w, interop.ErrUnknownTenant, "The client's tenant no longer exists")
+		return
+	}
+
+	addresses := updateRequest.Addresses()
+	var allowed []string
+	var rejected []interop.IPRejection
+	for _, address := range addresses {
+		if rejection := clientTenant.ipPolicy.check(address); rejection != nil {
+			log.Printf("Ignoring the IP address %s: %s", address, rejection.Detail)
+			rejected = append(rejected, *rejection)
+		} else {
+			allowed = append(allowed, address)
+		}
+	}
+	if len(allowed) == 0 {
+		msg := fmt.Sprintf("None of the IP addresses passed in are allowed: %s", strings.Join(addresses, ", "))
+		log.Printf("%s", msg)
+		updateResponse := interop.UpdateIPResponse{Success: false, Message: msg, RejectedIPs: rejected, Error: newAPIError(interop.ErrNoAllowedIPs, msg)}
+		writeFailureResponse(w, interop.ErrNoAllowedIPs, updateResponse)
+		return
+	}
+
+	extraNames, err := getClientNames(client.uuid)
+	if err != nil {
+		log.Printf("Could not load the client's names, error: %s", err)
+		writeFailure(w, interop.ErrInternal, "Could not update the IP addresses")
+		return
+	}
+	if err := updateClientIPs(client.uuid, allowed); err != nil {
+		log.Printf("Could not update the client's IP addresses, error: %s", err)
+		writeFailure(w, interop.ErrInternal, "Could not update the IP addresses")
+		return
+	}
+
+	log.Printf("Updating the DNS records for %s to %s", client.hostname, strings.Join(allowed, ", "))
+	for _, name := range clientTenant.certificateNames(client.hostname, extraNames) {
+		if err := SetAddressRecords(name, allowed); err != nil {
+			log.Printf("Could not update the address records for %s, error: %s", name, err)
+			writeFailure(w, interop.ErrInternal, "Could not update the DNS records")
+			return
 		}
 	}
-	return false
+
+	updateResponse := interop.UpdateIPResponse{Success: true, Message: "done", Hostname: clientTenant.fqdn(client.hostname), IPs: allowed, RejectedIPs: rejected}
+	writeJSON(w, http.StatusOK, updateResponse)
 }
 
 func registerClient(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
 	log.Printf("Call to register a client")
 
 	var regClient interop.RegClientRequest
-	err := json.NewDecoder(r.Body).Decode(&regClient)
-
-	// error doesn't seem to do much. It DOES NOT pick up on fields that have been missed
-	// see https://github.com/golang/go/issues/10140 and https://stackoverflow.com/questions/19633763/unmarshaling-json-in-golang-required-field
-	if err != nil {
-		log.Printf("Invalid request, aborting")
-		log.Debugf("There was an error decoding the JSON: %s", err)
-		regClientResponse := interop.RegClientResponse{Hostname: "", Success: false, Message: fmt.Sprintf("Error decoding the JSON\nError message: %s", err)}
-		s := regClientResponse.Marshall()
-		writeError(w, s)
+	if !decodeRequest(w, r, &regClient) {
 		return
 	}
 
@@ -234,99 +397,126 @@ func registerClient(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := (fmt.Sprintf("Client ID was not in the expected format: %s", regClient.ClientID))
 		log.Debugf("%s", msg)
-		regClientResponse := interop.RegClientResponse{Hostname: "", Success: false, Message: msg}
-		s := regClientResponse.Marshall()
-		writeError(w, s)
+		writeFailure(w, interop.ErrInvalidClientID, msg)
 		return
 	}
 	regClient.ClientID = parsedUuid.String()
 	log.Printf("The client ID is: %s", regClient.ClientID)
 
-	/*
-		This is an optional check put in here to try to stop the demo system from being
-		abused by creating certificates for public facing sites.
-	*/
-	if !isPrivateIP(net.ParseIP(regClient.IP)) {
-		msg := (fmt.Sprintf("The IP address passed in is not private: %s", regClient.IP))
-		log.Printf("%s", msg)
-		regClientResponse := interop.RegClientResponse{Hostname: "", Success: false, Message: msg}
-		s := regClientResponse.Marshall()
-		log.Debugf("The marshalled message is: %s", s)
-		writeError(w, s)
+	if ok, retryAfter := allowClient(regClient.ClientID); !ok {
+		log.Printf("Rate limiting registrations from client %s", regClient.ClientID)
+		writeRateLimited(w, retryAfter, "Too many requests from this client")
 		return
 	}
-	regClient.ClientID = parsedUuid.String()
-	log.Debugf("The IP address is: %s", regClient.IP)
 
-	row := database.QueryRow("SELECT COUNT(*) FROM clients WHERE uuid=?", regClient.ClientID)
-	var count int
-	err = row.Scan(&count)
+	clientTenant, err := tenantForToken(regClient.EnrollmentToken)
 	if err != nil {
-		fmt.Fprintf(w, "There was an error checking the database")
-		log.Fatal("Error on the scan, error: %s", err)
-	}
-	// log.Printf("The count is %d", count)
-	if count > 0 {
-		log.Printf("The client is already registered, aborting")
-		regClientResponse := interop.RegClientResponse{Hostname: "", Success: false, Message: "The client with provided UUID is already registered"}
-		s := regClientResponse.Marshall()
-		writeError(w, s)
+		log.Printf("Invalid enrollment token, aborting")
+		writeFailure(w, interop.ErrInvalidEnrollmentToken, err.Error())
 		return
 	}
-	log.Debug("Generating a hostname")
-	var hostname string
-	for {
-		hostname = generateHostname()
-		log.Printf("Hostname generated for client: %s", hostname)
-		row := database.QueryRow("SELECT COUNT(*) FROM clients WHERE hostname=?", hostname)
-		var count int
-		err := row.Scan(&count)
-		if err != nil {
-			log.Fatalf("Error on the scan, error: %s", err)
-		}
-		// log.Printf("the count is %d", count)
-		if count > 0 {
-			log.Debug("Hostname already exists, going around again")
+	log.Printf("The client is registering with the tenant: %s", clientTenant.Name)
+
+	if !clientTenant.managesAddresses() {
+		msg := fmt.Sprintf("The server can't publish address records under %s", clientTenant.Domain)
+		log.Printf("%s, the tenant %s has no Cloudflare credentials", msg, clientTenant.Name)
+		writeFailure(w, interop.ErrDNSNotManaged, msg)
+		return
+	}
+
+	addresses := regClient.Addresses()
+	var allowed []string
+	var rejected []interop.IPRejection
+	for _, address := range addresses {
+		if rejection := clientTenant.ipPolicy.check(address); rejection != nil {
+			log.Printf("Ignoring the IP address %s: %s", address, rejection.Detail)
+			rejected = append(rejected, *rejection)
 		} else {
-			log.Debug("Hostname is unique")
-			break
+			allowed = append(allowed, address)
 		}
 	}
-	log.Debug("Doing the insert")
-	_, err = database.Exec("INSERT INTO clients (uuid, hostname, IP) VALUES (?,?,?)", regClient.ClientID, hostname, regClient.IP)
-
-	if err != nil {
-		log.Fatalf("Could not insert data into the database, error: %s", err)
+	if len(allowed) == 0 {
+		msg := (fmt.Sprintf("None of the IP addresses passed in are allowed: %s", strings.Join(addresses, ", ")))
+		log.Printf("%s", msg)
+		regClientResponse := interop.RegClientResponse{Hostname: "", Success: false, Message: msg, RejectedIPs: rejected, Error: newAPIError(interop.ErrNoAllowedIPs, msg)}
+		writeFailureResponse(w, interop.ErrNoAllowedIPs, regClientResponse)
+		return
 	}
+	log.Debugf("The IP addresses are: %s", strings.Join(allowed, ", "))
 
-	log.Printf("Creating DNS record")
-	log.Debugf("Creating A record for %s with IP %s", hostname, regClient.IP)
-	fqdn := fmt.Sprintf("%s.%s", hostname, Cfg.Domain)
-	CreateOrUpdateDNSRecord("A", fqdn, regClient.IP)
-
-	regClientResponse := interop.RegClientResponse{Hostname: fqdn, Success: true, Message: "done"}
-	js, err := json.Marshal(regClientResponse)
+	log.Debug("Generating a hostname")
+	hostnameReq := hostnameRequest{
+		ClientID:  regClient.ClientID,
+		Serial:    regClient.Serial,
+		Model:     regClient.Model,
+		Requested: regClient.Hostname,
+	}
+	hostname, substitutionReason, err := allocateRequestedHostname(clientTenant, hostnameReq, strings.Join(allowed, ","))
 	if err != nil {
-		log.Fatalf(fmt.Sprintf("Error marshalling the JSON request: %s", err.Error()))
+		msg := err.Error()
+		var code string
+		_, badHostname := err.(hostnameError)
+		switch {
+		case err == errClientExists:
+			log.Printf("The client is already registered, aborting")
+			code = interop.ErrClientExists
+		case err == errHostnamesExhausted:
+			log.Printf("No free hostnames, aborting")
+			code = interop.ErrHostnamesExhausted
+		case err == errHostnameTaken:
+			log.Printf("The hostname is taken, aborting")
+			code = interop.ErrHostnameTaken
+		case err == errQuotaExceeded:
+			log.Printf("The tenant %s has no space for more clients, aborting", clientTenant.Name)
+			code = interop.ErrTenantFull
+		case badHostname:
+			log.Printf("Could not generate a hostname, aborting")
+			code = interop.ErrInvalidHostname
+		default:
+			log.Printf("Could not insert data into the database, error: %s", err)
+			code = interop.ErrInternal
+			msg = "Could not register the client"
+		}
+		writeFailure(w, code, msg)
 		return
 	}
-	s := string(js[:])
 
-	fmt.Fprintf(w, s)
+	fqdn := clientTenant.fqdn(hostname)
+	log.Debug("Adding the extra names")
+	extraNames, refusedNames := allocateExtraNames(clientTenant, regClient.ClientID, hostname, regClient.Serial, regClient.Alias)
+	names := clientTenant.certificateNames(hostname, extraNames)
+
+	logChallengeCNAMEs(names)
+
+	log.Printf("Creating DNS records")
+	for i, name := range names {
+		log.Debugf("Creating address records for %s with IPs %s", name, strings.Join(allowed, ", "))
+		if err := SetAddressRecords(name, allowed); err != nil {
+			log.Printf("Could not create the address records for %s, error: %s", name, err)
+			// Undo the registration so the client can try again from
+			// scratch rather than holding names with no records
+			for _, created := range names[:i+1] {
+				if err := SetAddressRecords(created, nil); err != nil {
+					log.Printf("Could not remove the address records for %s, error: %s", created, err)
+				}
+			}
+			if err := deleteClient(regClient.ClientID); err != nil {
+				log.Printf("Could not remove the client %s, error: %s", regClient.ClientID, err)
+			}
+			writeFailure(w, interop.ErrInternal, "Could not create the DNS records")
+			return
+		}
+	}
+
+	regClientResponse := interop.RegClientResponse{Hostname: fqdn, Success: true, Message: "done", SubstitutionReason: substitutionReason, RejectedIPs: rejected, Names: names, RefusedNames: refusedNames}
+	writeJSON(w, http.StatusOK, regClientResponse)
 }
 
 func welcomeMessage(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Hit on /, display welcome message")
 
 	message := fmt.Sprintf("Welcome to the OTS Certificate generator for %s", Cfg.Domain)
-	js, err := json.Marshal(message)
-	if err != nil {
-		log.Fatalf(fmt.Sprintf("Error marshalling the JSON request: %s", err.Error()))
-		return
-	}
-	s := string(js[:])
-
-	fmt.Fprintf(w, s)
+	writeJSON(w, http.StatusOK, message)
 }
 
 // Set the content type for all requests to JSON
@@ -337,16 +527,32 @@ func commonMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-var mutex = &sync.Mutex{}
-
 func StartWebServer() {
 	router := mux.NewRouter()
 	// Used to set the content type on all requests
 	router.Use(commonMiddleware)
+	router.Use(rateLimitMiddleware)
+
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/register", registerClient).Methods("POST")
+	v1.HandleFunc("/certificate", generateCertificate).Methods("POST")
+	v1.HandleFunc("/renewal_info", renewalInfo).Methods("POST")
+	v1.HandleFunc("/update_ip", updateIP).Methods("POST")
+	if Cfg.Admin.Token != "" {
+		v1.HandleFunc("/admin/quota", adminQuota).Methods("GET")
+	}
 
-	router.HandleFunc("/get_certificate", generateCertificate).Methods("POST")
-	router.HandleFunc("/register", registerClient).Methods("POST")
+	// The routes from before /v1/
+	router.HandleFunc("/get_certificate", deprecatedRoute("/v1/certificate", generateCertificate)).Methods("POST")
+	router.HandleFunc("/register", deprecatedRoute("/v1/register", registerClient)).Methods("POST")
+	router.HandleFunc("/renewal_info", deprecatedRoute("/v1/renewal_info", renewalInfo)).Methods("POST")
 	router.HandleFunc("/", welcomeMessage).Methods("GET")
+	if Cfg.Admin.Token != "" {
+		router.HandleFunc("/admin/quota", deprecatedRoute("/v1/admin/quota", adminQuota)).Methods("GET")
+	}
 
 	ip := Cfg.WebServer.IP
 	port := Cfg.WebServer.Port
@@ -354,7 +560,15 @@ func StartWebServer() {
 	log.Printf(fmt.Sprintf("Starting web server on: https://%s.%s:%d", Cfg.Hostname, Cfg.Domain, Cfg.WebServer.Port))
 	log.Debugf(fmt.Sprintf("Listening on: %s", listenOn))
 
-	err := http.ListenAndServeTLS(listenOn, Cfg.WebServer.CertFilename, Cfg.WebServer.KeyFilename, router)
+	server := &http.Server{
+		Addr:              listenOn,
+		Handler:           router,
+		ReadHeaderTimeout: time.Duration(Cfg.WebServer.ReadTimeout) * time.Second,
+		ReadTimeout:       time.Duration(Cfg.WebServer.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(Cfg.WebServer.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(Cfg.WebServer.IdleTimeout) * time.Second,
+	}
+	err := server.ListenAndServeTLS(Cfg.WebServer.CertFilename, Cfg.WebServer.KeyFilename)
 
 	if err != nil {
 		log.Fatalf("There was a problem starting the web server, error: ", err)